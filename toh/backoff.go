@@ -0,0 +1,58 @@
+package toh
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff decides how long to wait before retrying, it is shared by the retry paths of the dialer (see Dialer.Backoff)
+// and may be called concurrently. Attempt starts from 1 for the first retry, Reset is called after a success
+type Backoff interface {
+	Next(attempt int) time.Duration
+	Reset()
+}
+
+// ConstantBackoff waits the same delay before every retry
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+func (b *ConstantBackoff) Next(attempt int) time.Duration { return b.Delay }
+
+func (b *ConstantBackoff) Reset() {}
+
+// ExponentialBackoff doubles the delay on each retry starting from Base, capped at Max (0 means no cap).
+// Jitter (0-1) randomly shortens each delay by up to the fraction, so conns failed together won't retry together.
+// With Jitter of 0 the delays are deterministic, which is useful in tests
+type ExponentialBackoff struct {
+	Base   time.Duration
+	Max    time.Duration
+	Jitter float64
+}
+
+func (b *ExponentialBackoff) Next(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := b.Base
+	for i := 1; i < attempt && (b.Max == 0 || d < b.Max); i++ {
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	if b.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * b.Jitter * float64(d))
+	}
+	return d
+}
+
+func (b *ExponentialBackoff) Reset() {}
+
+// backoff returns the delay before the retry, fallback is used if Backoff is not set
+func (d *Dialer) backoff(attempt int, fallback time.Duration) time.Duration {
+	if d.Backoff != nil {
+		return d.Backoff.Next(attempt)
+	}
+	return fallback
+}
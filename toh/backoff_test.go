@@ -0,0 +1,26 @@
+package toh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &ExponentialBackoff{Base: 100 * time.Millisecond, Max: time.Second}
+	for attempt, want := range []time.Duration{100, 100, 200, 400, 800, 1000, 1000} {
+		if d := b.Next(attempt); d != want*time.Millisecond {
+			t.Fatal(attempt, d)
+		}
+	}
+
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := b.Next(3); d < 200*time.Millisecond || d > 400*time.Millisecond {
+			t.Fatal(d)
+		}
+	}
+
+	if d := (&ConstantBackoff{Delay: time.Second}).Next(10); d != time.Second {
+		t.Fatal(d)
+	}
+}
@@ -0,0 +1,87 @@
+package toh
+
+// readBuffer is the backing store of readConn.buf, it is not goroutine safe
+type readBuffer interface {
+	Write(p []byte)
+	Read(p []byte) int
+	Len() int
+	// Take removes and returns all buffered data
+	Take() []byte
+}
+
+// sliceBuffer is a plain slice, it grows by append and shrinks by slicing from the front
+type sliceBuffer struct {
+	buf []byte
+}
+
+func (b *sliceBuffer) Write(p []byte) { b.buf = append(b.buf, p...) }
+
+func (b *sliceBuffer) Read(p []byte) int {
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n
+}
+
+func (b *sliceBuffer) Len() int { return len(b.buf) }
+
+func (b *sliceBuffer) Take() []byte {
+	buf := b.buf
+	b.buf = nil
+	return buf
+}
+
+// ringBuffer reuses a fixed array, it only grows when the data exceeds the capacity
+type ringBuffer struct {
+	buf  []byte
+	head int // read position
+	size int // number of buffered bytes
+}
+
+func newRingBuffer(capacity int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, capacity)}
+}
+
+func (b *ringBuffer) Write(p []byte) {
+	if b.size+len(p) > len(b.buf) {
+		// Grow, this should be rare in steady streams
+		c := len(b.buf) * 2
+		for c < b.size+len(p) {
+			c *= 2
+		}
+		buf := make([]byte, c)
+		b.read(buf)
+		b.buf, b.head = buf, 0
+	}
+
+	tail := (b.head + b.size) % len(b.buf)
+	n := copy(b.buf[tail:], p)
+	copy(b.buf, p[n:])
+	b.size += len(p)
+}
+
+// read copies data into p without consuming
+func (b *ringBuffer) read(p []byte) int {
+	if b.size < len(p) {
+		p = p[:b.size]
+	}
+	n := copy(p, b.buf[b.head:])
+	if n < len(p) {
+		n += copy(p[n:], b.buf)
+	}
+	return n
+}
+
+func (b *ringBuffer) Read(p []byte) int {
+	n := b.read(p)
+	b.head = (b.head + n) % len(b.buf)
+	b.size -= n
+	return n
+}
+
+func (b *ringBuffer) Len() int { return b.size }
+
+func (b *ringBuffer) Take() []byte {
+	buf := make([]byte, b.size)
+	b.Read(buf)
+	return buf
+}
@@ -0,0 +1,32 @@
+package toh
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestRingBuffer(t *testing.T) {
+	ring, slice := newRingBuffer(16), &sliceBuffer{}
+
+	for i := 0; i < 1e4; i++ {
+		if rand.Intn(2) == 0 {
+			p := make([]byte, rand.Intn(40))
+			rand.Read(p)
+			ring.Write(p)
+			slice.Write(p)
+			continue
+		}
+
+		n := rand.Intn(40)
+		p1, p2 := make([]byte, n), make([]byte, n)
+		n1, n2 := ring.Read(p1), slice.Read(p2)
+		if n1 != n2 || !bytes.Equal(p1[:n1], p2[:n2]) || ring.Len() != slice.Len() {
+			t.Fatal(n1, n2, ring.Len(), slice.Len())
+		}
+	}
+
+	if !bytes.Equal(ring.Take(), slice.Take()) || ring.Len() != 0 {
+		t.Fatal("unmatched take")
+	}
+}
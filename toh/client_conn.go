@@ -1,84 +1,286 @@
 package toh
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
-
-	"github.com/coyove/common/sched"
 )
 
 type ClientConn struct {
 	idx    uint64
 	dialer *Dialer
+	ctx    context.Context // in-flight requests will be canceled when the conn is closed
+	cancel context.CancelFunc
+	pooled bool // see ConnStats.Pooled
+
+	created    time.Time
+	sentBytes  uint64 // data sent successfully, retries are not counted
+	sentFrames uint64
+	rtt        int64         // duration of the last successful send, including reading the response headers
+	retry      time.Duration // how long a send is retried before the conn fails, see TimeoutJitter
 
 	write struct {
 		sync.Mutex
 		counter uint32
-		sched   sched.SchedKey
+		sched   schedKey
 		buf     []byte
+		closed  bool // CloseWrite has been called
+		eof     bool // the EOF frame is yet to be sent
 		survey  struct {
 			lastIsPositive bool
-			pendingSize    int
+			pendingSize    int64 // accessed atomically, see setPendingSize
 			reschedCount   int64
+			lastActive     int64 // monotime of the last write or received data
+			idle           int32 // 1 if polling is stopped in client driven mode
+			sendFailed     int32 // 1 if the last send failed
+			nextSend       int64 // monotime of the earliest time the next request can be sent, see MaxRequestRate
+			rateWaiting    int32 // 1 if a send is waiting for its slot under MaxRequestRate
+			failures       int   // consecutive failed attempts across sends, see FailureThreshold
 		}
-		respCh     chan io.ReadCloser
-		respChOnce sync.Once
+		respCh        chan io.ReadCloser
+		respChOnce    sync.Once
+		flushInterval time.Duration
+		deadline      writeDeadline
+		buffered      int64         // len(buf), readable while a send holds the lock, see WriteBufferedBytes
+		marks         []writeMark   // priorities of data in buf, see WritePriority
+		cap           int64         // cap of buf, 0 means MaxWriteBuffer, see SetWriteBufferCap
+		grown         chan struct{} // closed and replaced when cap grows, see growth
+		grownmu       sync.Mutex
 	}
 
 	read *readConn
 }
 
 func (d *Dialer) Dial() (net.Conn, error) {
+	return d.DialContext(context.Background())
+}
+
+// DialContext acts like Dial, ctx is respected across the retries of handshake
+func (d *Dialer) DialContext(ctx context.Context) (net.Conn, error) {
+	return d.dial(ctx, nil)
+}
+
+// DialEarly acts like DialContext, data are carried by the hello and delivered to the server side conn
+// before it is accepted, which saves a round trip for protocols where the client speaks first.
+// The data are at most MaxEarlyData bytes, they are resent with the retries of hello, but are lost
+// if Dial fails. Servers unaware of early data ignore them, the data will be written to the conn then
+func (d *Dialer) DialEarly(ctx context.Context, data []byte) (net.Conn, error) {
+	if len(data) > MaxEarlyData {
+		return nil, ErrEarlyDataTooLarge
+	}
+	return d.dial(ctx, data)
+}
+
+func (d *Dialer) dial(ctx context.Context, early []byte) (net.Conn, error) {
+	if err := d.waitResume(ctx); err != nil {
+		return nil, err
+	}
+	if d.dialSem != nil {
+		select {
+		case d.dialSem <- struct{}{}:
+			defer func() { <-d.dialSem }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
 	if d.WebSocket {
-		return d.wsHandshake()
+		conn, err := d.wsHandshake()
+		if err == nil && len(early) > 0 {
+			_, err = conn.Write(early)
+		}
+		return conn, err
 	}
-	return d.newClientConn()
+	return d.newClientConn(ctx, early)
 }
 
-func (d *Dialer) newClientConn() (net.Conn, error) {
-	c := &ClientConn{dialer: d}
-	c.idx = newConnectionIdx()
+func (d *Dialer) allocClientConn(idx uint64) *ClientConn {
+	c := &ClientConn{dialer: d, created: time.Now()}
+	c.idx = idx
+	c.retry = jitter(d.Timeout-time.Second, d.TimeoutJitter)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 	c.write.survey.pendingSize = 1
-	c.write.respCh = make(chan io.ReadCloser, 128)
-	c.read = newReadConn(c.idx, d.blk, 'c')
+	c.write.survey.lastActive = monotime()
+	c.write.respCh = make(chan io.ReadCloser, d.RespQueueSize)
+	c.write.flushInterval = d.FlushInterval
+	c.write.grown = make(chan struct{})
+	c.read = newReadConn(c.idx, d.blk, 'c', &d.CommonOptions)
+	c.read.lookup = d.lookupReadConn
+	return c
+}
+
+// startClientConn starts the sending scheduler and response loop of the conn
+func (d *Dialer) startClientConn(c *ClientConn) {
+	c.write.sched.Reschedule(c.schedSending, c.write.flushInterval)
+
+	d.connsmu.Lock()
+	d.conns[c.idx] = c
+	d.connsmu.Unlock()
+	d.emit(c.idx, "created", "")
+
+	go c.respLoop()
+}
+
+func (d *Dialer) newClientConn(ctx context.Context, early []byte) (net.Conn, error) {
+	c := d.allocClientConn(newConnectionIdx())
+
+	// The caller's ctx aborts the hello in flight too, not only the retries
+	hctx, cancel := mergeContext(ctx, c.ctx)
+	defer cancel()
 
 	// Say hello
-	resp, err := c.send(frame{
-		idx:     rand.Uint32(),
-		connIdx: c.idx,
-		options: optSyncConnIdx,
-		next: &frame{
+	var err error
+	for i := 0; i < d.HandshakeAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(d.backoff(i, d.HandshakeBackoff)):
+			case <-ctx.Done():
+				c.cancel()
+				c.read.close()
+				return nil, ctx.Err()
+			}
+		}
+
+		// The version is unknown until acknowledged, so the hello itself is of version 1,
+		// its idx is random so the nonce won't collide with the ack's
+		hello := frame{idx: rand.Uint32(), connIdx: c.idx, options: optHello, data: append(newHelloData(), d.maxFrameVersion())}
+		if d.NoFrameEncryption {
+			hello.options |= optPlaintext
+		}
+		dataKey := d.dataBlk != nil && !d.NoFrameEncryption
+		flags := byte(helloEndFrame)
+		if dataKey {
+			flags |= helloDataKey
+		}
+		if len(early) > 0 {
+			// The first data frame follows the hello
+			flags |= helloEarlyData
+			if d.helloBlk != nil {
+				flags |= helloEarlyKey
+			}
+			// Frames are sealed in place, the caller's buffer must be kept intact for retries and the fallback
+			hello.next = &frame{idx: 1, connIdx: c.idx, data: append([]byte(nil), early...), next: &endframe}
+		}
+		version := d.ClientVersion
+		if len(version) > MaxClientVersion {
+			version = version[:MaxClientVersion]
+		}
+		hello.data = append(append(hello.data, flags), version...)
+
+		// Whether the hello reused an idle HTTP connection, see ConnStats.Pooled
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { c.pooled = info.Reused }}
+
+		var resp *http.Response
+		resp, err = c.sendContext(httptrace.WithClientTrace(hctx, trace), frame{
+			idx:     rand.Uint32(),
 			connIdx: c.idx,
-			options: optHello,
-		}})
-	if err != nil {
-		return nil, err
+			options: optSyncConnIdx,
+			next:    &hello,
+		})
+		if se, ok := err.(*StatusError); ok && se.Code == http.StatusUnauthorized {
+			// Retrying won't help
+			err = ErrAuthFailed
+			break
+		}
+		if err == nil {
+			// Servers unaware of versions respond nothing, while a response which can't be decrypted
+			// comes from a server of another key (e.g. answered by OnBadRequest)
+			ack, _, perr := parseframeAny(resp.Body, d.blk)
+			if perr == errFrameAuth {
+				resp.Body.Close()
+				err = ErrAuthFailed
+				break
+			}
+			ok := perr == nil
+			if ok && ack.options&optHello > 0 && len(ack.data) > 0 {
+				c.read.version = ack.data[0]
+			}
+			resp.Body.Close()
+			if d.ServerKey != nil && !(ok && ack.options&optHello > 0 && verifyHelloAck(d.ServerKey, hello.data, c.idx, ack.data)) {
+				// Whoever answered knows the network key, but isn't the server, retrying won't help
+				err = ErrServerAuth
+				break
+			}
+			if len(early) > 0 {
+				if ok && len(ack.data) > 1 && ack.data[1]&helloEarlyData > 0 {
+					c.write.counter = 1
+				} else {
+					c.push(early, 0, true)
+				}
+			}
+			c.read.endFrame = ok && len(ack.data) > 1 && ack.data[1]&helloEndFrame > 0
+			if dataKey && !(ok && len(ack.data) > 1 && ack.data[1]&helloDataKey > 0) {
+				// Data frames would be dropped by the server as forged ones
+				err = ErrDataKeyUnsupported
+				break
+			}
+			c.read.blk = d.dataBlock()
+			if i > 0 && d.Backoff != nil {
+				d.Backoff.Reset()
+			}
+			d.startClientConn(c)
+			return c, nil
+		}
+		vprint("handshake #", i+1, " failed: ", err)
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
 	}
-	resp.Body.Close()
 
-	c.write.sched = sched.Schedule(c.schedSending, time.Second)
+	c.cancel()
+	c.read.close()
+	return nil, err
+}
 
-	go c.respLoop()
-	return c, nil
+func (d *Dialer) lookupReadConn(connIdx uint64) *readConn {
+	d.connsmu.Lock()
+	defer d.connsmu.Unlock()
+	if c := d.conns[connIdx]; c != nil {
+		return c.read
+	}
+	return nil
 }
 
+// SetDeadline sets both deadlines. Deadlines are absolute points in wall-clock time, bound to the conn
+// rather than to any HTTP request carrying it: retries of failed requests, new underlying connections
+// and Export/Import (which carries them in ConnState) never reset or extend them
 func (c *ClientConn) SetDeadline(t time.Time) error {
 	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
 	return nil
 }
 
+// SetContext binds ctx to the reading side: a blocked Read (or WriteTo) returns ctx.Err() as soon as ctx is done,
+// rather than waiting for data or the deadline. The conn stays open, the caller should close it if no longer needed
+func (c *ClientConn) SetContext(ctx context.Context) {
+	c.read.setContext(ctx)
+}
+
 func (c *ClientConn) SetReadDeadline(t time.Time) error {
-	c.read.ready.SetWaitDeadline(t)
+	c.read.setReadDeadline(t)
 	return nil
 }
 
+// SetWriteDeadline bounds the time Write waits for the full write buffer to be drained. While it is set,
+// a large Write is buffered in pieces as sends make room in MaxWriteBuffer, so it may time out with
+// a partial count of the bytes buffered, which will be sent anyway
 func (c *ClientConn) SetWriteDeadline(t time.Time) error {
+	c.write.deadline.set(t)
 	return nil
 }
 
@@ -91,53 +293,278 @@ func (c *ClientConn) RemoteAddr() net.Addr {
 }
 
 func (c *ClientConn) Close() error {
-	if c.read.closed {
+	return c.closeWith(nil)
+}
+
+// CloseWithError closes the conn, the server side will get a *CloseError of the code and reason from Read
+func (c *ClientConn) CloseWithError(code int, reason string) error {
+	return c.closeWith(&CloseError{Code: code, Reason: reason})
+}
+
+func (c *ClientConn) closeWith(e *CloseError) error {
+	if c.read.localClosed {
 		return nil
 	}
 
 	vprint(c, " closing")
+	c.read.shutdown()
+	if c.closeLocal() {
+		c.dialer.workers.Go(func() {
+			// The conn's context has been canceled, tell the server without it
+			resp, err := c.sendContext(context.Background(), frame{
+				connIdx: c.idx,
+				options: optClosed,
+				version: c.read.version,
+				data:    e.marshal(),
+			})
+			if err == nil {
+				resp.Body.Close()
+			}
+		})
+	}
+	return nil
+}
+
+// closeLocal closes the conn without telling the server, it returns true if the conn is closed by this call
+func (c *ClientConn) closeLocal() (closed bool) {
+	c.cancel()
 	c.write.sched.Cancel()
 	c.read.close()
+	c.dialer.connsmu.Lock()
+	delete(c.dialer.conns, c.idx)
+	c.dialer.connsmu.Unlock()
 	c.write.respChOnce.Do(func() {
 		close(c.write.respCh)
-		go c.send(frame{
+		closed = true
+		c.dialer.emit(c.idx, "closed", c.read.closeReason())
+	})
+	return
+}
+
+// drainWriteBuf sends until the write buffer is empty, it returns early when ctx expires, or the conn is
+// closed or failed
+func (c *ClientConn) drainWriteBuf(ctx context.Context) error {
+	for sent := true; ; sent = c.trySendWriteBuf() {
+		if err, closed := c.read.status(); err != nil {
+			return err
+		} else if closed || !sent || c.ctx.Err() != nil {
+			return errClosedConn
+		}
+		if c.WriteBufferedBytes() == 0 {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if atomic.LoadInt32(&c.write.survey.rateWaiting) == 1 {
+			// The send waiting under MaxRequestRate will carry the data
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// CloseWait flushes all buffered data, and closes the conn. Unlike Close which is fire-and-forget,
+// it blocks until the server acknowledges the close, or ctx expires
+func (c *ClientConn) CloseWait(ctx context.Context) error {
+	if c.read.closed {
+		return errClosedConn
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		if err := c.drainWriteBuf(ctx); err != nil {
+			errCh <- err
+			return
+		}
+
+		resp, err := c.sendContext(ctx, frame{
 			connIdx: c.idx,
 			options: optClosed,
+			version: c.read.version,
 		})
-	})
-	return nil
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer resp.Body.Close()
+
+		if f, ok := parseframe(resp.Body, c.dialer.blk); !ok || f.options != optClosed || f.connIdx != c.idx {
+			errCh <- ErrCloseNotAcked
+			return
+		}
+		errCh <- nil
+	}()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	vprint(c, " closing, error: ", err)
+	c.read.shutdown()
+	c.closeLocal()
+	return err
+}
+
+// Barrier flushes all buffered data, and blocks until the server acknowledges that all data written before
+// have been received and appended to its read buffer in order, or ctx expires. It doesn't wait for them
+// to be read by the server side application. Unlike CloseWait, the conn stays open
+func (c *ClientConn) Barrier(ctx context.Context) error {
+	if c.read.closed {
+		return errClosedConn
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		if err := c.drainWriteBuf(ctx); err != nil {
+			errCh <- err
+			return
+		}
+
+		c.write.Lock()
+		counter := c.write.counter
+		c.write.Unlock()
+
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, counter)
+		resp, err := c.sendContext(ctx, frame{
+			connIdx: c.idx,
+			options: optBarrier,
+			version: c.read.version,
+			data:    data,
+		})
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer resp.Body.Close()
+
+		f, ok := parseframe(resp.Body, c.dialer.blk)
+		if !ok || f.options != optBarrier || f.connIdx != c.idx || len(f.data) < 4 || binary.BigEndian.Uint32(f.data) < counter {
+			errCh <- ErrBarrierNotAcked
+			return
+		}
+		errCh <- nil
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (c *ClientConn) Write(p []byte) (n int, err error) {
+	return c.WritePriority(p, 0)
+}
+
+// WritePriority acts like Write, while the data jump ahead of buffered data of lower priorities, writes of
+// the same priority are sent in order. Data of a single call are always sent as a whole, so unlike Write,
+// a prioritized (non-zero) write is buffered in full after the deadline check, regardless of MaxWriteBuffer
+func (c *ClientConn) WritePriority(p []byte, prio int) (n int, err error) {
 REWRITE:
 	if c.read.err != nil {
-		return 0, c.read.err
+		return n, c.read.err
 	}
 
 	if c.read.closed {
-		return 0, errClosedConn
+		return n, errClosedConn
 	}
 
-	if len(c.write.buf) > c.dialer.MaxWriteBuffer {
-		vprint("write buffer is full")
-		time.Sleep(time.Second)
-		goto REWRITE
+	if c.write.deadline.exceeded() {
+		return n, &timeoutError{}
 	}
 
+	// Taken before the check, so growing in between still wakes the wait
+	grown := c.growth()
+	max := c.writeBufferCap()
+
 	c.write.Lock()
+	if c.write.closed {
+		c.write.Unlock()
+		return n, ErrWriteAfterClose
+	}
+	full := len(c.write.buf) > max
+	if c.write.deadline.enabled() {
+		full = len(c.write.buf) >= max
+	}
+	if full {
+		c.write.Unlock()
+		if c.dialer.NonBlockingWrite {
+			return n, ErrBufferFull
+		}
+		vprint("write buffer is full")
+		c.write.deadline.wait(grown)
+		goto REWRITE
+	}
 	c.write.sched.Reschedule(func() {
-		c.write.survey.pendingSize = 1
+		c.setPendingSize(1)
 		c.schedSending()
-	}, time.Second)
-	c.write.buf = append(c.write.buf, p...)
+	}, c.write.flushInterval)
+	chunk := p
+	if prio == 0 {
+		chunk = c.write.deadline.chunk(p, len(c.write.buf), max)
+	}
+	// The rest of a write whose beginning may have been sent, nothing can jump ahead of it
+	c.push(chunk, prio, n > 0)
+	atomic.StoreInt32(&c.write.survey.idle, 0)
+	atomic.StoreInt64(&c.write.survey.lastActive, monotime())
+	pending := len(c.write.buf) >= int(atomic.LoadInt64(&c.write.survey.pendingSize))
 	c.write.Unlock()
+	n, p = n+len(chunk), p[len(chunk):]
+
+	if pending {
+		c.schedSending()
+	}
+	if len(p) > 0 {
+		// The rest waits for the buffer to be drained
+		goto REWRITE
+	}
+	return n, nil
+}
 
-	if len(c.write.buf) < c.write.survey.pendingSize {
-		return len(p), nil
+// CloseWrite shuts down the writing side, the server side will read io.EOF after all data written before.
+// Any further Write will return ErrWriteAfterClose, reading is not affected
+func (c *ClientConn) CloseWrite() error {
+	if c.read.closed {
+		return errClosedConn
 	}
 
-	c.schedSending()
-	return len(p), nil
+	c.write.Lock()
+	if c.write.closed {
+		c.write.Unlock()
+		return nil
+	}
+	c.write.closed, c.write.eof = true, true
+	c.write.Unlock()
+
+	c.dialer.workers.Go(c.sendWriteBuf)
+	return nil
+}
+
+// CloseRead shuts down the reading side, buffered and further incoming data are discarded and Read
+// returns io.EOF. The server is told to stop sending, its Write will return ErrReadClosedByRemote.
+// Writing is not affected
+func (c *ClientConn) CloseRead() error {
+	if c.read.closed {
+		return errClosedConn
+	}
+	c.read.closeRead()
+
+	c.dialer.workers.Go(func() {
+		ctx, cancel := context.WithTimeout(c.ctx, c.dialer.Timeout)
+		defer cancel()
+		resp, err := c.sendContext(ctx, frame{connIdx: c.idx, options: optReadClosed, version: c.read.version})
+		if err != nil {
+			vprint(c, " close read: ", err)
+			return
+		}
+		resp.Body.Close()
+	})
+	return nil
 }
 
 func (c *ClientConn) schedSending() {
@@ -148,85 +575,419 @@ func (c *ClientConn) schedSending() {
 		return
 	}
 
+	if idle := c.dialer.ClientDriven; idle > 0 && atomic.LoadInt64(&c.write.buffered) == 0 &&
+		monotime()-atomic.LoadInt64(&c.write.survey.lastActive) > int64(idle) {
+		// Stop polling until the next Write or Poll
+		atomic.StoreInt32(&c.write.survey.idle, 1)
+		return
+	}
+
 	c.dialer.orchSendWriteBuf(c)
 	c.write.sched.Reschedule(func() {
-		c.write.survey.pendingSize = 1
+		c.setPendingSize(1)
 		c.schedSending()
-	}, time.Second)
+	}, c.write.flushInterval)
+}
+
+// SetFlushInterval sets the max time buffered data will wait before being sent, d <= 0 restores FlushInterval of the dialer
+func (c *ClientConn) SetFlushInterval(d time.Duration) {
+	if d <= 0 {
+		d = c.dialer.FlushInterval
+	}
+	c.write.Lock()
+	c.write.flushInterval = d
+	c.write.Unlock()
+}
+
+// Poll resumes polling the server for data, it is only useful when the connection
+// has stopped polling in client driven mode
+func (c *ClientConn) Poll() {
+	atomic.StoreInt64(&c.write.survey.lastActive, monotime())
+	atomic.StoreInt32(&c.write.survey.idle, 0)
+	c.schedSending()
+}
+
+// OptimalWriteSize returns the recommended write size for callers doing their own buffering.
+// Writes smaller than the adaptive pending size wait to be coalesced until the next poll or flush,
+// while larger ones mean fewer requests, as long as they fit in MaxWriteBuffer next to the buffered data,
+// otherwise the write after them blocks (or fails by NonBlockingWrite). It changes as the conn sends
+func (c *ClientConn) OptimalWriteSize() int {
+	c.write.Lock()
+	pending, buffered := int(atomic.LoadInt64(&c.write.survey.pendingSize)), len(c.write.buf)
+	c.write.Unlock()
+	max := c.writeBufferCap()
+	return optimalWriteSize(pending, max/4, max-buffered)
+}
+
+// WriteBufferedBytes returns the number of bytes written but not sent yet, it doesn't wait for sends in flight
+func (c *ClientConn) WriteBufferedBytes() int {
+	return int(atomic.LoadInt64(&c.write.buffered))
+}
+
+// SetWriteBufferCap replaces MaxWriteBuffer of the conn at runtime, n <= 0 restores it. When shrinking below
+// the buffered data, nothing is dropped: they are sent right away, and Write blocks (or fails by NonBlockingWrite)
+// until the buffer goes below the new cap. When growing, blocked writes are woken to fill the room
+func (c *ClientConn) SetWriteBufferCap(n int) {
+	if n < 0 {
+		n = 0
+	}
+	old := c.writeBufferCap()
+	atomic.StoreInt64(&c.write.cap, int64(n))
+
+	if max := c.writeBufferCap(); max > old {
+		c.write.grownmu.Lock()
+		close(c.write.grown)
+		c.write.grown = make(chan struct{})
+		c.write.grownmu.Unlock()
+	} else if int(atomic.LoadInt64(&c.write.buffered)) > max {
+		c.dialer.orchSendWriteBuf(c)
+	}
+}
+
+// growth returns the channel closed when the cap of the write buffer grows next time, see SetWriteBufferCap
+func (c *ClientConn) growth() <-chan struct{} {
+	c.write.grownmu.Lock()
+	defer c.write.grownmu.Unlock()
+	return c.write.grown
+}
+
+// writeBufferCap returns the cap of the write buffer, see SetWriteBufferCap
+func (c *ClientConn) writeBufferCap() int {
+	if n := atomic.LoadInt64(&c.write.cap); n > 0 {
+		return int(n)
+	}
+	return c.dialer.MaxWriteBuffer
+}
+
+// ReadBufferedBytes returns the number of bytes received but not read yet
+func (c *ClientConn) ReadBufferedBytes() int {
+	return c.read.buffered()
+}
+
+const maxPendingSize = 1024
+
+// setPendingSize updates the adaptive pending size, OnSendSizeEvent will be called
+// when it saturates (reaches maxPendingSize) or collapses (resets to 1)
+func (c *ClientConn) setPendingSize(size int) {
+	old := int(atomic.SwapInt64(&c.write.survey.pendingSize, int64(size)))
+	if cb := c.dialer.OnSendSizeEvent; cb != nil && old != size && (size == 1 || size == maxPendingSize) {
+		cb(old, size)
+	}
+}
+
+// waitRequestRate blocks until the conn is allowed to send the next request under MaxRequestRate. If another
+// send of the conn is already waiting for its slot, it returns coalesced at once, writes happened in the meantime
+// will be carried by that send. It returns early with the error of the conn context once the conn is closed
+func (c *ClientConn) waitRequestRate() (coalesced bool, err error) {
+	if c.dialer.MaxRequestRate <= 0 {
+		return false, nil
+	}
+	interval := int64(float64(time.Second) / c.dialer.MaxRequestRate)
+	for {
+		now := monotime()
+		next := atomic.LoadInt64(&c.write.survey.nextSend)
+		if next <= now {
+			if atomic.CompareAndSwapInt64(&c.write.survey.nextSend, next, now+interval) {
+				return false, nil
+			}
+			continue
+		}
+
+		if !atomic.CompareAndSwapInt32(&c.write.survey.rateWaiting, 0, 1) {
+			return true, nil
+		}
+		if !atomic.CompareAndSwapInt64(&c.write.survey.nextSend, next, next+interval) {
+			atomic.StoreInt32(&c.write.survey.rateWaiting, 0)
+			continue
+		}
+		// Released before the send takes the buffer, so writes seeing it set are always carried
+		defer atomic.StoreInt32(&c.write.survey.rateWaiting, 0)
+
+		t := time.NewTimer(time.Duration(next - now))
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return false, nil
+		case <-c.ctx.Done():
+			return false, c.ctx.Err()
+		}
+	}
 }
 
 func (c *ClientConn) sendWriteBuf() {
+	c.trySendWriteBuf()
+}
+
+// trySendWriteBuf sends the write buffer, it returns false if it is not sent because the conn is closed or failed.
+// A send coalesced into the one waiting under MaxRequestRate returns true
+func (c *ClientConn) trySendWriteBuf() (sent bool) {
+	if c.dialer.waitResume(c.ctx) != nil {
+		return false
+	}
+	if coalesced, err := c.waitRequestRate(); err != nil {
+		return false
+	} else if coalesced {
+		return true
+	}
+
 	c.write.Lock()
 	defer c.write.Unlock()
 
-	if c.write.survey.pendingSize *= 2; c.write.survey.pendingSize > 1024 {
-		c.write.survey.pendingSize = 1024
+	if size := int(atomic.LoadInt64(&c.write.survey.pendingSize)) * 2; size > maxPendingSize {
+		c.setPendingSize(maxPendingSize)
+	} else {
+		c.setPendingSize(size)
 	}
 
 	if c.read.err != nil {
-		return
+		return false
 	}
+	c.pinWriteBuf()
 
 	f := frame{
 		idx:     rand.Uint32(),
 		connIdx: c.idx,
 		options: optSyncConnIdx,
+		version: c.read.version,
 		next: &frame{
 			idx:     c.write.counter + 1,
 			connIdx: c.idx,
+			version: c.read.version,
 			data:    c.write.buf,
+			next:    &endframe,
 		},
 	}
+	eof := c.write.eof
+	if eof {
+		// All data are in this request, append the EOF frame right after them
+		f.next.next = &frame{idx: c.write.counter + 2, connIdx: c.idx, options: optClosed, version: c.read.version, next: &endframe}
+	}
 
-	deadline := time.Now().Add(c.dialer.Timeout - time.Second)
-	for {
+	start := time.Now()
+	deadline := start.Add(c.retry)
+	for attempt := 1; ; attempt++ {
+		sent := time.Now()
 		if resp, err := c.send(f); err != nil {
-			if time.Now().After(deadline) {
+			atomic.StoreInt32(&c.write.survey.sendFailed, 1)
+			c.write.survey.failures++
+			vprint(c, " send attempt ", attempt, " failed after ", time.Since(start), ", ", sendErrorKind(err), ": ", err)
+			if cb := c.dialer.OnSendError; cb != nil {
+				cb(attempt, err)
+			}
+			if c.ctx.Err() != nil {
+				// Closed
+				return false
+			}
+			if c.sendFailed(deadline) {
 				c.read.feedError(err)
-				return
+				return false
+			}
+			if wait := c.dialer.backoff(attempt, 0); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-c.ctx.Done():
+					return false
+				}
 			}
 		} else {
-			c.write.buf = c.write.buf[:0]
+			if attempt > 1 && c.dialer.Backoff != nil {
+				c.dialer.Backoff.Reset()
+			}
+			atomic.StoreInt32(&c.write.survey.sendFailed, 0)
+			c.write.survey.failures = 0
+			atomic.StoreInt64(&c.rtt, int64(time.Since(sent)))
+			if len(c.write.buf) > 0 {
+				atomic.AddUint64(&c.sentBytes, uint64(len(c.write.buf)))
+				atomic.AddUint64(&c.sentFrames, 1)
+			}
+			c.read.sizes.observeSent(len(c.write.buf))
+			c.write.buf, c.write.marks = c.write.buf[:0], c.write.marks[:0]
+			atomic.StoreInt64(&c.write.buffered, int64(len(c.write.buf)))
 			c.write.counter++
+			if eof {
+				c.write.counter++
+				c.write.eof = false
+			}
 			func() {
 				defer func() { recover() }()
 				select {
 				case c.write.respCh <- resp.Body:
 				default:
+					if c.dialer.OverflowPolicy == OverflowError {
+						resp.Body.Close()
+						c.read.feedError(ErrQueueFull)
+						return
+					}
 					go func(resp *http.Response) {
-						c.read.feedframes(resp.Body)
+						c.feedBody(resp.Body)
 						resp.Body.Close()
 					}(resp)
 				}
 			}()
-			break
+			return true
 		}
 	}
 }
 
+// sendFailed returns true if the conn should be failed after a failed attempt: by FailureThreshold if set,
+// otherwise when retries run past the deadline
+func (c *ClientConn) sendFailed(deadline time.Time) bool {
+	if k := c.dialer.FailureThreshold; k > 0 {
+		return c.write.survey.failures >= k
+	}
+	return time.Now().After(deadline)
+}
+
 func (c *ClientConn) send(f frame) (resp *http.Response, err error) {
-	client := &http.Client{
-		Timeout:   c.dialer.Timeout,
-		Transport: c.dialer.Transport,
+	return c.sendContext(c.ctx, f)
+}
+
+func (c *ClientConn) sendContext(ctx context.Context, f frame) (resp *http.Response, err error) {
+	client := c.dialer.HTTPClient
+	if client == nil {
+		client = &http.Client{
+			Timeout:   c.dialer.sendTimeout(f.size()),
+			Transport: c.dialer.Transport,
+		}
+	}
+
+	// The first frame is always encrypted by the key, so the server can authenticate the request
+	body := f.marshal(c.dialer.blk)
+	if f.next != nil && c.read.blk != c.dialer.blk {
+		head := f
+		head.next = nil
+		body = io.MultiReader(head.marshal(c.dialer.blk), f.next.marshal(c.read.blk))
+	} else if hello := f.next; hello != nil && hello.options&optHello > 0 && hello.next != nil && c.dialer.helloBlk != nil {
+		// Early data following the hello are encrypted by HelloKey
+		head, h := f, *hello
+		head.next, h.next = &h, nil
+		body = io.MultiReader(head.marshal(c.dialer.blk), hello.next.marshal(c.dialer.helloBlk))
 	}
 
-	req, _ := http.NewRequest("POST", "http://"+c.dialer.endpoint+c.dialer.URLPath, f.marshal(c.read.blk))
+	req, err := c.dialer.newRequest(body)
+	if err != nil {
+		return nil, err
+	}
+	// WithClientTrace modifies the trace in place, so it can't be shared
+	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{GotConn: c.dialer.gotConn}))
 	resp, err = client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
 		resp.Body.Close()
-		return nil, fmt.Errorf("remote is unavailable: %s", resp.Status)
+		return nil, &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	if cb := c.dialer.OnResponseHeaders; cb != nil {
+		cb(resp.Header)
 	}
 	return resp, nil
 }
 
+// ErrAuthFailed is returned by Dial when the server can't authenticate the hello, or the client can't
+// authenticate the response, usually the network (key) of both sides doesn't match
+var ErrAuthFailed = fmt.Errorf("authentication failed, mismatched network key")
+
+// ErrServerAuth is returned by Dial when the hello response isn't signed by Dialer.ServerKey
+var ErrServerAuth = fmt.Errorf("server authentication failed, the hello response isn't signed by the server key")
+
+// StatusError is returned when the server responds with a non-200 status
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return "remote is unavailable: " + e.Status
+}
+
+// sendErrorKind classifies errors of send for logging
+func sendErrorKind(err error) string {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	if oe, ok := err.(*net.OpError); ok {
+		if _, ok := oe.Err.(*net.DNSError); ok {
+			return "dns"
+		}
+		if se, ok := oe.Err.(*os.SyscallError); ok && se.Err == syscall.ECONNREFUSED {
+			return "connection refused"
+		}
+	}
+	switch e := err.(type) {
+	case *StatusError:
+		return "non-200"
+	case *net.DNSError:
+		return "dns"
+	case net.Error:
+		if e.Timeout() {
+			return "timeout"
+		}
+	}
+	return "other"
+}
+
+// maxGetPayload is the max size of payloads carried in the header of GET requests
+const maxGetPayload = 4096
+
+func (d *Dialer) newRequest(body io.Reader) (*http.Request, error) {
+	scheme := "http://"
+	if d.TLSConfig != nil {
+		scheme = "https://"
+	}
+	u := scheme + d.endpoint + d.URLPath
+	method := d.Methods[rand.Intn(len(d.Methods))]
+
+	// Frames are marshalled in memory anyway, buffering them gives the request a Content-Length,
+	// some reverse proxies reject chunked request bodies with 411
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if method == "GET" {
+		if len(buf) > maxGetPayload {
+			// Payload is too large for a header, fall back to other methods
+			for _, m := range d.Methods {
+				if m != "GET" {
+					return http.NewRequest(m, u, bytes.NewReader(buf))
+				}
+			}
+			return http.NewRequest("POST", u, bytes.NewReader(buf))
+		}
+
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(payloadHeader, base64.RawURLEncoding.EncodeToString(buf))
+		return req, nil
+	}
+
+	return http.NewRequest(method, u, bytes.NewReader(buf))
+}
+
+func (d *Dialer) sendTimeout(size int) time.Duration {
+	if d.BaseTimeout == 0 {
+		return d.Timeout
+	}
+	t := d.BaseTimeout
+	if d.BytesPerSecondFloor > 0 {
+		t += time.Duration(size) * time.Second / time.Duration(d.BytesPerSecondFloor)
+	}
+	return t
+}
+
+// respLoop is the only loop processing response bodies of the conn, one after another. Bodies which overflow
+// respCh are processed in their own goroutines (see OverflowPolicy), the reassembler orders frames by counter
+// anyway, so the order of processing doesn't affect what Read returns
 func (c *ClientConn) respLoop() {
 	for body := range c.write.respCh {
-		k := sched.Schedule(func() { body.Close() }, c.dialer.Timeout)
-		if n, _ := c.read.feedframes(body); n == 0 {
+		k := schedule(func() { body.Close() }, c.dialer.Timeout)
+		if n, _ := c.feedBody(body); n == 0 {
 			c.write.survey.lastIsPositive = false
+		} else {
+			atomic.StoreInt64(&c.write.survey.lastActive, monotime())
 		}
 		k.Cancel()
 		body.Close()
@@ -234,10 +995,114 @@ func (c *ClientConn) respLoop() {
 	vprint(c, " resp out")
 }
 
+// bufferedBody reads the response body through a buffer, and closes the body itself
+type bufferedBody struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// feedBody feeds frames of the response body, read through a pooled buffer of ReadBufferSize
+func (c *ClientConn) feedBody(body io.ReadCloser) (int, error) {
+	br := c.dialer.readers.Get().(*bufio.Reader)
+	br.Reset(body)
+	defer func() {
+		br.Reset(nil)
+		c.dialer.readers.Put(br)
+	}()
+	return c.read.feedframes(bufferedBody{br, body})
+}
+
 func (c *ClientConn) Read(p []byte) (n int, err error) {
 	return c.read.Read(p)
 }
 
+func (c *ClientConn) WriteTo(w io.Writer) (n int64, err error) {
+	return c.read.WriteTo(w)
+}
+
+// ConnStats is a snapshot of the conn, the JSON names are stable and safe to be consumed by dashboards
+type ConnStats struct {
+	Idx            uint64        `json:"idx"`
+	Endpoint       string        `json:"endpoint"`
+	State          string        `json:"state"` // one of: active, idle, failing, closed
+	ReadCounter    uint32        `json:"read_counter"`
+	WriteCounter   uint32        `json:"write_counter"`
+	PendingSize    int           `json:"pending_size"`
+	Healthy        bool          `json:"healthy"`
+	Pooled         bool          `json:"pooled"` // the hello reused an idle HTTP connection of the transport, rather than a new one
+	BytesSent      uint64        `json:"bytes_sent"`
+	BytesReceived  uint64        `json:"bytes_received"`
+	FramesSent     uint64        `json:"frames_sent"`
+	FramesReceived uint64        `json:"frames_received"`
+	RTT            time.Duration `json:"rtt_ns"` // of the last successful send
+	Age            time.Duration `json:"age_ns"`
+
+	// Frames which arrived before earlier ones and had to wait, and the max distance of such a frame
+	// from the expected one. Growing numbers indicate a marginal link, even though the data are intact
+	Reordered uint64 `json:"reordered"`
+	MaxGap    uint32 `json:"max_gap"`
+
+	// Bytes written but not sent yet, and received but not read yet, see WriteBufferedBytes and ReadBufferedBytes
+	WriteBuffered int `json:"write_buffered"`
+	ReadBuffered  int `json:"read_buffered"`
+
+	// HOLBlocked is the total time frames which have arrived waited for a missing one, i.e. head-of-line
+	// blocking, which Unordered avoids. It is always 0 in unordered mode
+	HOLBlocked time.Duration `json:"hol_blocked_ns"`
+}
+
+func (c *ClientConn) Stats() ConnStats {
+	c.read.Lock()
+	recvBytes, recvFrames := c.read.recvBytes, c.read.recvFrames
+	reordered, maxGap, hol := c.read.reordered, c.read.maxGap, c.read.holBlockedTime()
+	readBuffered := c.read.buf.Len()
+	c.read.Unlock()
+
+	state := "active"
+	switch {
+	case c.read.err != nil || c.read.closed:
+		state = "closed"
+	case atomic.LoadInt32(&c.write.survey.sendFailed) == 1:
+		state = "failing"
+	case atomic.LoadInt32(&c.write.survey.idle) == 1:
+		state = "idle"
+	}
+
+	return ConnStats{
+		Idx:            c.idx,
+		Endpoint:       c.dialer.endpoint,
+		State:          state,
+		ReadCounter:    c.read.counter,
+		WriteCounter:   c.write.counter,
+		PendingSize:    int(atomic.LoadInt64(&c.write.survey.pendingSize)),
+		Healthy:        c.Healthy(),
+		Pooled:         c.pooled,
+		BytesSent:      atomic.LoadUint64(&c.sentBytes),
+		BytesReceived:  recvBytes,
+		FramesSent:     atomic.LoadUint64(&c.sentFrames),
+		FramesReceived: recvFrames,
+		RTT:            time.Duration(atomic.LoadInt64(&c.rtt)),
+		Age:            time.Since(c.created),
+		Reordered:      reordered,
+		MaxGap:         maxGap,
+		WriteBuffered:  c.WriteBufferedBytes(),
+		ReadBuffered:   readBuffered,
+		HOLBlocked:     hol,
+	}
+}
+
+// Healthy returns false if the conn has failed, been closed or its last send failed, it issues no I/O
+func (c *ClientConn) Healthy() bool {
+	err, closed := c.read.status()
+	return err == nil && !closed && atomic.LoadInt32(&c.write.survey.sendFailed) == 0
+}
+
+// SetLogTag makes logs of the conn show tag (e.g. a trace ID) instead of the conn index, so they can be
+// correlated with logs of the application. The tag stays local, an empty tag restores the index
+func (c *ClientConn) SetLogTag(tag string) {
+	c.read.setLogTag(tag)
+}
+
 func (c *ClientConn) String() string {
-	return fmt.Sprintf("<C:%x,r:%d,w:%d>", c.idx, c.read.counter, c.write.counter)
+	return fmt.Sprintf("<C:%s,r:%d,w:%d>", c.read.logTagOr(fmt.Sprintf("%x", c.idx)), c.read.counter, c.write.counter)
 }
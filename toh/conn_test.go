@@ -1,19 +1,30 @@
 package toh
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"runtime"
 	"runtime/pprof"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -150,3 +161,2484 @@ func TestHTTPServer(t *testing.T) {
 
 	ln.Close()
 }
+
+func TestFlushInterval(t *testing.T) {
+	ln, _ := Listen("tcp", "127.0.0.1:13741")
+	defer ln.Close()
+
+	recv := make(chan time.Time, 2)
+	go func() {
+		conn, _ := ln.Accept()
+		p := [1]byte{}
+		for i := 0; i < 2; i++ {
+			conn.Read(p[:])
+			recv <- time.Now()
+		}
+	}()
+
+	conn, _ := NewDialer("tcp", "127.0.0.1:13741", WithFlushInterval(time.Millisecond*100)).Dial()
+	conn.Write([]byte{1})
+	<-recv
+
+	// The second small write will be buffered until the flush timer fires
+	start := time.Now()
+	conn.Write([]byte{2})
+	select {
+	case ts := <-recv:
+		if d := ts.Sub(start); d > time.Millisecond*600 {
+			t.Fatal("flushed too late: ", d)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("not flushed")
+	}
+}
+
+func TestFlushIntervalNonPositive(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	d := NewDialer("tcp", ln.Addr().String(), WithFlushInterval(-time.Millisecond))
+	if d.FlushInterval != time.Second {
+		t.Fatal(d.FlushInterval)
+	}
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := conn.(*ClientConn)
+	c.SetFlushInterval(100 * time.Millisecond)
+	c.SetFlushInterval(-1)
+	if c.write.flushInterval != time.Second {
+		t.Fatal(c.write.flushInterval)
+	}
+}
+
+// countingTransport counts requests in flight, a request ends when its response body is closed
+type countingTransport struct {
+	inflight int64
+}
+
+type countingBody struct {
+	io.ReadCloser
+	once sync.Once
+	t    *countingTransport
+}
+
+func (b *countingBody) Close() error {
+	b.once.Do(func() { atomic.AddInt64(&b.t.inflight, -1) })
+	return b.ReadCloser.Close()
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.inflight, 1)
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		atomic.AddInt64(&t.inflight, -1)
+		return nil, err
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, t: t}
+	return resp, nil
+}
+
+func TestCloseCancelsSends(t *testing.T) {
+	// Held responses keep requests in flight
+	ln, _ := Listen("tcp", "127.0.0.1:13742", WithServerPush(time.Second*10))
+	defer ln.Close()
+	go ln.Accept()
+
+	tr := &countingTransport{}
+	conn, _ := NewDialer("tcp", "127.0.0.1:13742", WithTransport(tr), WithFlushInterval(time.Millisecond*100)).Dial()
+
+	deadline := time.Now().Add(time.Second * 2)
+	for atomic.LoadInt64(&tr.inflight) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no request in flight")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	conn.Close()
+	deadline = time.Now().Add(time.Second)
+	for atomic.LoadInt64(&tr.inflight) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("requests are still in flight: ", atomic.LoadInt64(&tr.inflight))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestServerPushClose(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0", WithServerPush(time.Second*10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Data and the close are pushed onto the held response
+	time.Sleep(200 * time.Millisecond)
+	sc.Write([]byte("pushed"))
+	sc.(*ServerConn).CloseWithError(6, "done")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf, err := ioutil.ReadAll(conn)
+	if ce, ok := err.(*CloseError); !ok || ce.Code != 6 || string(buf) != "pushed" {
+		t.Fatal(string(buf), err)
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serveErrs int32
+	ln.(*Listener).OnServeError = func(error) { atomic.AddInt32(&serveErrs, 1) }
+
+	done := make(chan bool)
+	go func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() { defer wg.Done(); ln.Close() }()
+		}
+		wg.Wait()
+		ln.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := ln.Accept(); err != errClosedListener {
+			t.Fatal("Accept on closed listener: ", err)
+		}
+	}
+	if atomic.LoadInt32(&serveErrs) != 0 {
+		t.Fatal("Close is reported as a serve error")
+	}
+}
+
+func TestServeError(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	l := ln.(*Listener)
+
+	errs := make(chan error, 2)
+	l.OnServeError = func(err error) { errs <- err }
+
+	// The underlying listener dies without Close
+	l.ln.Close()
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatal("OnServeError not called")
+	}
+
+	// Accept keeps returning the same error
+	_, err1 := ln.Accept()
+	_, err2 := ln.Accept()
+	if err1 == nil || err1 != err2 {
+		t.Fatal(err1, err2)
+	}
+	if len(errs) != 0 {
+		t.Fatal("OnServeError called again")
+	}
+}
+
+func TestWriteAfterCloseWrite(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf, err := ioutil.ReadAll(conn)
+		if err != nil || string(buf) != "hello" {
+			done <- fmt.Errorf("server read: %q, %v", buf, err)
+			return
+		}
+		sc := conn.(*ServerConn)
+		sc.Write([]byte("world"))
+		sc.CloseWrite()
+		if _, err := sc.Write([]byte("!")); err != ErrWriteAfterClose {
+			done <- fmt.Errorf("server write after CloseWrite: %v", err)
+			return
+		}
+		done <- nil
+	}()
+
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := conn.(*ClientConn)
+	c.Write([]byte("hello"))
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("!")); err != ErrWriteAfterClose {
+		t.Fatal("client write after CloseWrite:", err)
+	}
+
+	// Reading still works after CloseWrite
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf, err := ioutil.ReadAll(c)
+	if err != nil || string(buf) != "world" {
+		t.Fatalf("client read: %q, %v", buf, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseWithError(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	d := NewDialer("tcp", ln.Addr().String())
+
+	// The dialer closes with a code
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.(*ClientConn).CloseWithError(3, "bye")
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := sc.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read after close")
+	} else if ce, ok := err.(*CloseError); !ok || ce.Code != 3 || ce.Reason != "bye" {
+		t.Fatal(err)
+	}
+	sc.Close()
+
+	// And the listener, after its data
+	conn, err = d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Write([]byte("world"))
+	sc.(*ServerConn).CloseWithError(4, "later")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf, err := ioutil.ReadAll(conn)
+	if ce, ok := err.(*CloseError); !ok || ce.Code != 4 || ce.Reason != "later" || string(buf) != "world" {
+		t.Fatal(string(buf), err)
+	}
+}
+
+func TestCloseByPeerWhileReading(t *testing.T) {
+	events := make(chan ConnEvent, 4)
+	ln, err := Listen("tcp", "127.0.0.1:0", WithEvents(events))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	// Read is already waiting when the close frame arrives
+	errCh := make(chan error, 1)
+	go func() {
+		sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := sc.Read(make([]byte, 1))
+		errCh <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	conn.(*ClientConn).CloseWithError(5, "gone")
+
+	if err := <-errCh; err == nil {
+		t.Fatal("read after close")
+	} else if ce, ok := err.(*CloseError); !ok || ce.Code != 5 || ce.Reason != "gone" {
+		t.Fatal(err)
+	}
+	for _, typ := range []string{"created", "closed"} {
+		select {
+		case e := <-events:
+			if e.Type != typ || (typ == "closed" && !strings.Contains(e.Reason, "gone")) {
+				t.Fatalf("%+v", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event of ", typ)
+		}
+	}
+}
+
+func TestCloseRead(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	c := conn.(*ClientConn)
+	sc.Write([]byte("dropped"))
+	if err := c.CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Read(make([]byte, 16)); n != 0 || err != io.EOF {
+		t.Fatal("client read after CloseRead: ", n, err)
+	}
+
+	// Writing still works
+	for i := 0; i < 3; i++ {
+		if _, err := c.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("server read: %q, %v", buf, err)
+		}
+	}
+
+	// The server is told to stop sending
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := sc.Write([]byte("world")); err == ErrReadClosedByRemote {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server write not failed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n, err := c.Read(make([]byte, 16)); n != 0 || err != io.EOF {
+		t.Fatal("client read: ", n, err)
+	}
+}
+
+func TestLargeResponse(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0", WithFrameSizeHistogram())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	const total, chunk = 16 << 20, 1 << 20
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		p := make([]byte, chunk)
+		for i := 0; i < total/chunk; i++ {
+			conn.Write(p)
+		}
+	}()
+
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Sample the live heap while transferring, the payload is never held whole. Conns of other tests
+	// may still come and go, so the bound is loose
+	liveHeap := func() uint64 {
+		var ms runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		return ms.HeapAlloc
+	}
+	base, peak := liveHeap(), uint64(0)
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(200 * time.Millisecond):
+			}
+			if h := liveHeap(); h > atomic.LoadUint64(&peak) {
+				atomic.StoreUint64(&peak, h)
+			}
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	n, err := io.CopyN(ioutil.Discard, conn, total)
+	close(done)
+	if err != nil {
+		t.Fatal(n, err)
+	}
+	if p := atomic.LoadUint64(&peak); p > base+total {
+		t.Fatal("heap grows from ", base, " to ", p)
+	}
+
+	sent, _ := ln.(*Listener).FrameSizes()
+	for _, b := range sent.Buckets {
+		if b.Le >= maxResponseFrameSize && b.Count != sent.Count {
+			t.Fatal("frames larger than ", maxResponseFrameSize, ": ", sent.Count-b.Count)
+		}
+	}
+}
+
+func TestReadToEOF(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// A bounded response spanning several frames, followed by the EOF
+	resp := bytes.Repeat([]byte("0123456789"), 20<<10)
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		for p := resp; len(p) > 0; {
+			n := 32 << 10
+			if n > len(p) {
+				n = len(p)
+			}
+			conn.Write(p[:n])
+			p = p[n:]
+		}
+		conn.(*ServerConn).CloseWrite()
+
+		// The client's writing side is not affected
+		buf := make([]byte, 4)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "done" {
+			done <- fmt.Errorf("server read: %q, %v", buf, err)
+			return
+		}
+		done <- nil
+	}()
+
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf, err := ioutil.ReadAll(conn)
+	if err != nil || !bytes.Equal(buf, resp) {
+		t.Fatal("read: ", len(buf), "/", len(resp), ", ", err)
+	}
+	if _, err := conn.Write([]byte("done")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSResumption(t *testing.T) {
+	l := NewListener("tcp")
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	defer l.Close()
+
+	var handshakes, resumed int32
+	srv := httptest.NewUnstartedServer(l.Handler())
+	srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if tc, ok := conn.(*tls.Conn); ok && state == http.StateActive {
+			atomic.AddInt32(&handshakes, 1)
+			if tc.ConnectionState().DidResume {
+				atomic.AddInt32(&resumed, 1)
+			}
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	d := NewDialer("tcp", strings.TrimPrefix(srv.URL, "https://"), WithTLSConfig(&tls.Config{RootCAs: pool}))
+	// Every request opens a new TLS connection
+	d.Transport.(*http.Transport).DisableKeepAlives = true
+
+	for i := 0; i < 3; i++ {
+		conn, err := d.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	if atomic.LoadInt32(&handshakes) < 3 || atomic.LoadInt32(&resumed) == 0 {
+		t.Fatal("handshakes:", handshakes, ", resumed:", resumed)
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	l := NewListener("tcp")
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	defer l.Close()
+
+	// A strict front-end which requires Content-Length
+	var rejected int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TransferEncoding) > 0 || (r.Method != "GET" && r.ContentLength < 0) {
+			atomic.AddInt32(&rejected, 1)
+			w.WriteHeader(http.StatusLengthRequired)
+			return
+		}
+		l.Handler().ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	conn, err := NewDialer("tcp", strings.TrimPrefix(srv.URL, "http://"), WithDirectSend()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	p := bytes.Repeat([]byte("x"), 64<<10)
+	if _, err := conn.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(p))
+	if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, p) {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&rejected); n > 0 {
+		t.Fatal("chunked requests: ", n)
+	}
+}
+
+// recordTransport keeps the first request and its body
+type recordTransport struct {
+	memTransport
+	once sync.Once
+	req  *http.Request
+	body []byte
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.once.Do(func() {
+		t.body, _ = ioutil.ReadAll(req.Body)
+		t.req = req
+		req.Body = ioutil.NopCloser(bytes.NewReader(t.body))
+	})
+	return t.memTransport.RoundTrip(req)
+}
+
+func TestReplayedHello(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	l := ln.(*Listener)
+
+	tr := &recordTransport{memTransport: memTransport{l}}
+	conn, err := NewDialer("tcp", ln.Addr().String(), WithTransport(tr)).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Close()
+	conn.Close()
+	idx := conn.(*ClientConn).idx
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		l.connsmu.Lock()
+		_, ok := l.conns[idx]
+		l.connsmu.Unlock()
+		if !ok {
+			break
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatal("conn not released")
+		}
+	}
+
+	// The hello replayed once the conn is gone doesn't create it again
+	req := tr.req.Clone(context.Background())
+	req.Body = ioutil.NopCloser(bytes.NewReader(tr.body))
+	resp, err := tr.memTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatal(resp.Status)
+	}
+	l.connsmu.Lock()
+	_, ok := l.conns[idx]
+	l.connsmu.Unlock()
+	if ok {
+		t.Fatal("replayed hello accepted")
+	}
+}
+
+func TestClockStep(t *testing.T) {
+	defer func() { wallclock = time.Now }()
+	rc := newReplayCache(16, helloWindow)
+
+	// The dialer's clock has been stepped an hour ahead
+	wallclock = func() time.Time { return time.Now().Add(time.Hour) }
+	skewed := newHelloData()
+	start := monotime()
+
+	wallclock = time.Now
+	if rc.check(skewed) || rc.skews != 1 {
+		t.Fatal("skewed hello accepted")
+	}
+	if !rc.check(newHelloData()) {
+		t.Fatal("hello rejected")
+	}
+
+	// Stepping the wall clock back doesn't affect durations
+	wallclock = func() time.Time { return time.Now().Add(-time.Hour) }
+	if d := time.Duration(monotime() - start); d < 0 || d > time.Minute {
+		t.Fatal(d)
+	}
+}
+
+func TestConnStatsJSON(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 5)
+		io.ReadFull(conn, buf)
+		conn.Write(buf)
+	}()
+
+	d := NewDialer("tcp", ln.Addr().String(), WithFlushInterval(100*time.Millisecond))
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("hello"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	conns := d.Connections()
+	if len(conns) != 1 || conns[0].BytesSent != 5 || conns[0].BytesReceived != 5 || conns[0].State != "active" {
+		t.Fatalf("%+v", conns)
+	}
+
+	buf, _ := json.Marshal(conns[0])
+	var m map[string]interface{}
+	json.Unmarshal(buf, &m)
+	for _, key := range []string{"idx", "endpoint", "state", "bytes_sent", "bytes_received", "frames_sent", "frames_received", "rtt_ns", "age_ns",
+		"write_buffered", "read_buffered"} {
+		if _, ok := m[key]; !ok {
+			t.Fatal("missing ", key, " in ", string(buf))
+		}
+	}
+}
+
+func TestServerMemoryLimit(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0", WithServerMemoryLimit(64<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	l := ln.(*Listener)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err := NewDialer("tcp", ln.Addr().String(), WithDirectSend()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const total, chunk = 512 << 10, 32 << 10
+	go func() {
+		p := make([]byte, chunk)
+		for i := 0; i < total/chunk; i++ {
+			for j := range p {
+				p[j] = byte(i*chunk + j)
+			}
+			conn.Write(p)
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	// The server doesn't read, requests are rejected once the limit is reached
+	sc := <-accepted
+	for start := time.Now(); l.HTTPStats().MemoryRejects == 0; time.Sleep(50 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("no rejects, usage: ", l.MemoryUsage())
+		}
+	}
+	if u := l.MemoryUsage(); u < 64<<10 || u >= total {
+		t.Fatal("usage: ", u)
+	}
+
+	// Then it reads everything intact
+	sc.SetReadDeadline(time.Now().Add(20 * time.Second))
+	buf := make([]byte, total)
+	if _, err := io.ReadFull(sc, buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := range buf {
+		if buf[i] != byte(i) {
+			t.Fatal("corrupted at ", i)
+		}
+	}
+	if u := l.MemoryUsage(); u != 0 {
+		t.Fatal("usage after reading: ", u)
+	}
+}
+
+func TestDialEarly(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	d := NewDialer("tcp", ln.Addr().String())
+	conn, err := d.DialEarly(context.Background(), []byte("early"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The data have arrived with the hello, before any write of the client
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.(*ServerConn).read.buf.Len() != 5 {
+		t.Fatal("early data not delivered")
+	}
+
+	conn.Write([]byte(" late"))
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "early late" {
+		t.Fatalf("%q %v", buf, err)
+	}
+
+	if _, err := d.DialEarly(context.Background(), make([]byte, MaxEarlyData+1)); err != ErrEarlyDataTooLarge {
+		t.Fatal(err)
+	}
+}
+
+// flakyTransport fails the first requests
+type flakyTransport struct {
+	memTransport
+	failures int32
+}
+
+func (t *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.AddInt32(&t.failures, -1) >= 0 {
+		req.Body.Close()
+		return nil, fmt.Errorf("flaky")
+	}
+	return t.memTransport.RoundTrip(req)
+}
+
+func TestDialEarlyRetried(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// The buffer has room for sealing in place, the retried hello must still carry the plain data
+	tr := &flakyTransport{memTransport: memTransport{ln.(*Listener)}, failures: 1}
+	d := NewDialer("tcp", ln.Addr().String(), WithTransport(tr), WithHandshakeRetry(2, time.Millisecond))
+	early := append(make([]byte, 0, 64), "early"...)
+	conn, err := d.DialEarly(context.Background(), early)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if string(early) != "early" {
+		t.Fatalf("buffer of the caller modified: %q", early)
+	}
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	buf := make([]byte, 5)
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "early" {
+		t.Fatalf("%q %v", buf, err)
+	}
+}
+
+func TestClientVersion(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	d := NewDialer("tcp", ln.Addr().String(), WithClientVersion("test/1.0"))
+	for _, early := range []string{"", "early"} {
+		conn, err := d.DialEarly(context.Background(), []byte(early))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		sc, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := sc.(*ServerConn).ClientVersion(); v != "test/1.0" {
+			t.Fatalf("%q", v)
+		}
+		if n := sc.(*ServerConn).read.buf.Len(); n != len(early) {
+			t.Fatal("early data: ", n)
+		}
+	}
+}
+
+func TestDataKey(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0", WithDataKey("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	l := ln.(*Listener)
+
+	d := NewDialer("tcp", ln.Addr().String(), WithDataKey("secret"))
+	conn, err := d.DialEarly(context.Background(), []byte("early"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	if sc.(*ServerConn).read.blk != l.dataBlk || conn.(*ClientConn).read.blk != d.dataBlk {
+		t.Fatal("data frames are not encrypted by the data key")
+	}
+
+	conn.Write([]byte("hello"))
+	sc.Write([]byte("world"))
+	buf := make([]byte, 10)
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "earlyhello" {
+		t.Fatal(string(buf), err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf[:5]); err != nil || string(buf[:5]) != "world" {
+		t.Fatal(string(buf[:5]), err)
+	}
+
+	if _, err := NewDialer("tcp", ln.Addr().String()).Dial(); err == nil {
+		t.Fatal("dialed without the data key")
+	}
+}
+
+func TestWithoutFrameEncryption(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// The listener doesn't allow plaintext by default
+	d := NewDialer("tcp", ln.Addr().String(), WithoutFrameEncryption())
+	if _, err := d.Dial(); err == nil {
+		t.Fatal("downgraded the listener")
+	}
+
+	ln.(*Listener).AllowPlaintext = true
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	_, cplain := conn.(*ClientConn).read.blk.(plainBlock)
+	_, splain := sc.(*ServerConn).read.blk.(plainBlock)
+	if !cplain || !splain {
+		t.Fatal("data frames are encrypted")
+	}
+
+	conn.Write([]byte("hello"))
+	sc.Write([]byte("world"))
+	buf := make([]byte, 5)
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "hello" {
+		t.Fatal(string(buf), err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "world" {
+		t.Fatal(string(buf), err)
+	}
+}
+
+func TestOptimalWriteSize(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	c := conn.(*ClientConn)
+	if n := c.OptimalWriteSize(); n != c.dialer.MaxWriteBuffer/4 {
+		t.Fatal(n)
+	}
+	if n := sc.(*ServerConn).OptimalWriteSize(); n != maxResponseFrameSize {
+		t.Fatal(n)
+	}
+
+	// Never more than the free space of the write buffer
+	if n := optimalWriteSize(maxPendingSize, c.dialer.MaxWriteBuffer/4, 100); n != 100 {
+		t.Fatal(n)
+	}
+}
+
+func TestNonBlockingWrite(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	d := NewDialer("tcp", ln.Addr().String(), WithNonBlockingWrite(), WithMaxWriteBuffer(1<<10))
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	// Nothing is sent while paused, the write over the cap fails immediately
+	d.Pause()
+	written := 0
+	for {
+		start := time.Now()
+		n, err := conn.Write(make([]byte, 2<<10))
+		written += n
+		if err != nil {
+			if err != ErrBufferFull || !err.(net.Error).Temporary() || n != 0 {
+				t.Fatal(n, err)
+			}
+			if d := time.Since(start); d > 100*time.Millisecond {
+				t.Fatal("write blocked: ", d)
+			}
+			break
+		}
+		if written > 8<<10 {
+			t.Fatal("the write buffer never fills")
+		}
+	}
+
+	d.Resume()
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(sc, make([]byte, written)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retrying succeeds once the buffer is drained
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := conn.Write([]byte("hello")); err == nil {
+			break
+		} else if err != ErrBufferFull || time.Since(start) > 5*time.Second {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWithTimeouts(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	d := NewDialer("tcp", ln.Addr().String(), WithMaxWriteBuffer(1<<10))
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	tc := WithTimeouts(conn, 200*time.Millisecond, 200*time.Millisecond)
+
+	// Every Read gets its own deadline
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		if _, err := tc.Read(make([]byte, 1)); err == nil || !err.(net.Error).Timeout() {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+			t.Fatal("timed out in ", d)
+		}
+	}
+	sc.Write([]byte("hello"))
+	for start := time.Now(); conn.(*ClientConn).ReadBufferedBytes() != 5; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("not received")
+		}
+	}
+	if _, err := io.ReadFull(tc, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	// So does every Write, which blocks on the full buffer while paused
+	d.Pause()
+	defer d.Resume()
+	if _, err := tc.Write(make([]byte, 1<<10)); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := tc.Write([]byte("!")); err == nil || !err.(net.Error).Timeout() {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Fatal("timed out in ", d)
+	}
+}
+
+func TestPause(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	l := ln.(*Listener)
+
+	d := NewDialer("tcp", ln.Addr().String())
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	d.Pause()
+	conn.Write([]byte("hello"))
+	// Let requests in flight complete
+	time.Sleep(time.Second)
+	requests := l.HTTPStats().Requests
+	time.Sleep(500 * time.Millisecond)
+	if n := l.HTTPStats().Requests; n != requests {
+		t.Fatal("requests sent while paused: ", n-requests)
+	}
+	if n := sc.(*ServerConn).read.buf.Len(); n != 0 {
+		t.Fatal("data sent while paused: ", n)
+	}
+
+	d.Resume()
+	buf := make([]byte, 5)
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "hello" {
+		t.Fatal(string(buf), err)
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := NewDialer("tcp", ln.Addr().String(), WithMaxWriteBuffer(64<<10)).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	// The buffer can't take all of it before the deadline
+	p := make([]byte, 1<<20)
+	conn.SetWriteDeadline(time.Now().Add(300 * time.Millisecond))
+	n, err := conn.Write(p)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal(err)
+	}
+	if n == 0 || n >= len(p) {
+		t.Fatal("not a partial write: ", n)
+	}
+	if _, err := conn.Write(p[:1]); err == nil {
+		t.Fatal("wrote after the deadline")
+	}
+
+	// Exactly the partial count arrives
+	buf := make([]byte, n+1)
+	sc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	nr, _ := io.ReadFull(sc, buf)
+	if nr != n {
+		t.Fatal(nr, n)
+	}
+
+	conn.SetWriteDeadline(time.Time{})
+	if _, err := conn.Write(p[:10]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// outageTransport fails all requests while down is set
+type outageTransport struct {
+	memTransport
+	down int32
+}
+
+func (t *outageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadInt32(&t.down) == 1 {
+		req.Body.Close()
+		return nil, fmt.Errorf("outage")
+	}
+	return t.memTransport.RoundTrip(req)
+}
+
+// stallTransport holds all requests until they are canceled while stalled is set
+type stallTransport struct {
+	memTransport
+	stalled int32
+}
+
+func (t *stallTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadInt32(&t.stalled) == 1 {
+		req.Body.Close()
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+	return t.memTransport.RoundTrip(req)
+}
+
+// waitGoroutinesGone fails the test if any goroutine is still running fn after a while
+func waitGoroutinesGone(t *testing.T, fn string) {
+	buf := make([]byte, 1<<20)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		if !strings.Contains(stacks, fn) {
+			return
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatalf("%s still running", fn)
+		}
+	}
+}
+
+func TestCloseWaitStalled(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tr := &stallTransport{memTransport: memTransport{ln.(*Listener)}}
+	d := NewDialer("tcp", ln.Addr().String(), WithTransport(tr))
+	for _, pause := range []bool{false, true} {
+		conn, err := d.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		atomic.StoreInt32(&tr.stalled, 1)
+		if pause {
+			d.Pause()
+		}
+		conn.Write([]byte("hello"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		start := time.Now()
+		err = conn.(*ClientConn).CloseWait(ctx)
+		cancel()
+		if err != context.DeadlineExceeded || time.Since(start) > time.Second {
+			t.Fatal(err, time.Since(start))
+		}
+		waitGoroutinesGone(t, "drainWriteBuf")
+
+		d.Resume()
+		atomic.StoreInt32(&tr.stalled, 0)
+	}
+}
+
+func TestDialContextStalled(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tr := &stallTransport{memTransport: memTransport{ln.(*Listener)}, stalled: 1}
+	d := NewDialer("tcp", ln.Addr().String(), WithTransport(tr), WithInactiveTimeout(3*time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := d.DialContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("hello in flight not aborted: ", time.Since(start))
+	}
+}
+
+// countTransport counts requests
+type countTransport struct {
+	memTransport
+	requests int64
+}
+
+func (t *countTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&t.requests, 1)
+	return t.memTransport.RoundTrip(req)
+}
+
+func TestClientDriven(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tr := &countTransport{memTransport: memTransport{ln.(*Listener)}}
+	d := NewDialer("tcp", ln.Addr().String(), WithTransport(tr),
+		WithClientDriven(200*time.Millisecond), WithFlushInterval(50*time.Millisecond))
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	conn.Write([]byte("hello"))
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(sc, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once idle (the polls in flight are done), the conn stops polling, so server data wait for Poll
+	time.Sleep(time.Second)
+	n := atomic.LoadInt64(&tr.requests)
+	sc.Write([]byte("world"))
+	time.Sleep(300 * time.Millisecond)
+	if m := atomic.LoadInt64(&tr.requests); m != n {
+		t.Fatal("polled while idle: ", m-n)
+	}
+	conn.(*ClientConn).Poll()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "world" {
+		t.Fatal(string(buf), err)
+	}
+}
+
+// gateTransport holds requests until released, counting those waiting
+type gateTransport struct {
+	memTransport
+	waiting int32
+	release chan struct{}
+}
+
+func (t *gateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.waiting, 1)
+	<-t.release
+	atomic.AddInt32(&t.waiting, -1)
+	return t.memTransport.RoundTrip(req)
+}
+
+func TestMaxConcurrentDials(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tr := &gateTransport{memTransport: memTransport{ln.(*Listener)}, release: make(chan struct{})}
+	d := NewDialer("tcp", ln.Addr().String(), WithTransport(tr), WithMaxConcurrentDials(2))
+	errs := make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		go func() {
+			conn, err := d.Dial()
+			if err == nil {
+				conn.Close()
+			}
+			errs <- err
+		}()
+	}
+
+	// Only 2 hellos are sent, the rest of Dial calls wait for them
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&tr.waiting); n != 2 {
+		t.Fatal("hellos in flight: ", n)
+	}
+	close(tr.release)
+	for i := 0; i < 6; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSendTimeoutScaled(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tr := &stallTransport{memTransport: memTransport{ln.(*Listener)}}
+	d := NewDialer("tcp", ln.Addr().String(), WithTransport(tr),
+		WithBaseTimeout(100*time.Millisecond), WithBytesPerSecondFloor(100<<10))
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := conn.(*ClientConn)
+
+	// Stalled requests time out after BaseTimeout plus the time sending the payload at the floor
+	atomic.StoreInt32(&tr.stalled, 1)
+	for _, size := range []int{0, 50 << 10} {
+		f := frame{idx: rand.Uint32(), connIdx: c.idx, options: optSyncConnIdx, next: &frame{idx: 1, connIdx: c.idx, data: make([]byte, size)}}
+		start := time.Now()
+		if _, err := c.sendContext(context.Background(), f); err == nil {
+			t.Fatal("stalled request succeeded")
+		}
+		want := 100*time.Millisecond + time.Duration(size)*time.Second/(100<<10)
+		if d := time.Since(start); d < want || d > want+300*time.Millisecond {
+			t.Fatal("timed out in ", d, ", want ", want)
+		}
+	}
+}
+
+func TestBarrierStalled(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tr := &stallTransport{memTransport: memTransport{ln.(*Listener)}}
+	conn, err := NewDialer("tcp", ln.Addr().String(), WithTransport(tr)).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	c := conn.(*ClientConn)
+
+	c.Write([]byte("hello"))
+	if err := c.Barrier(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(sc, make([]byte, 5)); err != nil {
+		t.Fatal("data before the barrier not received: ", err)
+	}
+
+	// The drain gives up with ctx, and exits once the conn is closed
+	atomic.StoreInt32(&tr.stalled, 1)
+	c.Write([]byte("world"))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := c.Barrier(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	c.Close()
+	waitGoroutinesGone(t, "drainWriteBuf")
+}
+
+func TestRequestRateClosed(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	d := NewDialer("tcp", ln.Addr().String(), WithMaxRequestRate(0.1), WithFlushInterval(10*time.Millisecond))
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	conn.Write([]byte("hello"))
+	sc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(sc, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next request waits 10s for its slot, closing the conn ends the wait
+	conn.Write([]byte("world"))
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+	waitGoroutinesGone(t, "waitRequestRate")
+}
+
+func TestRequestRateCoalesced(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	d := NewDialer("tcp", ln.Addr().String(), WithMaxRequestRate(2), WithFlushInterval(10*time.Millisecond))
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	// Writes within one slot are carried by a single waiting send, instead of each parking a worker
+	for i := 0; i < 20; i++ {
+		conn.Write([]byte{'a' + byte(i)})
+		time.Sleep(5 * time.Millisecond)
+	}
+	buf := make([]byte, 1<<20)
+	if n := strings.Count(string(buf[:runtime.Stack(buf, true)]), "(*ClientConn).waitRequestRate("); n > 1 {
+		t.Fatal("sends waiting: ", n)
+	}
+
+	sc.SetReadDeadline(time.Now().Add(3 * time.Second))
+	p := make([]byte, 20)
+	if _, err := io.ReadFull(sc, p); err != nil || string(p) != "abcdefghijklmnopqrst" {
+		t.Fatal(string(p), err)
+	}
+}
+
+func TestDeadlineAcrossReconnect(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tr := &outageTransport{memTransport: memTransport{ln.(*Listener)}}
+	d := NewDialer("tcp", ln.Addr().String(), WithTransport(tr))
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	// Requests failing and being retried don't extend the deadline
+	start := time.Now()
+	conn.SetDeadline(start.Add(500 * time.Millisecond))
+	atomic.StoreInt32(&tr.down, 1)
+	time.AfterFunc(300*time.Millisecond, func() { atomic.StoreInt32(&tr.down, 0) })
+	if _, err := conn.Read(make([]byte, 1)); err == nil || !err.(net.Error).Timeout() {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 450*time.Millisecond || d > time.Second {
+		t.Fatal("deadline moved: ", d)
+	}
+
+	// Nor does resuming the conn
+	start = time.Now()
+	conn.SetReadDeadline(start.Add(500 * time.Millisecond))
+	conn.SetWriteDeadline(start.Add(time.Hour))
+	buf, err := conn.(*ClientConn).Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	conn, err = d.Import(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); err == nil || !err.(net.Error).Timeout() {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 450*time.Millisecond || d > time.Second {
+		t.Fatal("deadline moved after import: ", d)
+	}
+	if dl := conn.(*ClientConn).write.deadline.get(); !dl.Equal(start.Add(time.Hour).Round(0)) {
+		t.Fatal("write deadline: ", dl)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(sc, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportUnread(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0", WithDataKey("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	d := NewDialer("tcp", ln.Addr().String(), WithDataKey("secret"))
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	if _, err := sc.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// A frame which arrived ahead of a missing one
+	c := conn.(*ClientConn)
+	c.read.Lock()
+	c.read.futureframes[c.read.counter+2] = frame{idx: c.read.counter + 2, connIdx: c.idx, data: []byte("!")}
+	c.read.futureSize++
+	c.read.Unlock()
+
+	buf, err := c.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDialer("tcp", ln.Addr().String()).Import(buf); err == nil {
+		t.Fatal("imported without the data key")
+	}
+	conn, err = d.Import(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := sc.Write([]byte("?")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p := make([]byte, 7)
+	if _, err := io.ReadFull(conn, p); err != nil {
+		t.Fatal(err)
+	}
+	if string(p) != "world?!" {
+		t.Fatal(string(p))
+	}
+}
+
+func TestLogTag(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	c, s := conn.(*ClientConn), sc.(*ServerConn)
+	idx := fmt.Sprintf("%x", c.idx)
+	if !strings.Contains(c.String(), idx) || !strings.Contains(s.String(), idx) {
+		t.Fatal(c, s)
+	}
+
+	c.SetLogTag("trace-1")
+	s.SetLogTag("trace-2")
+	if str := c.String(); !strings.Contains(str, "trace-1") || strings.Contains(str, idx) {
+		t.Fatal(str)
+	}
+	if str := fmt.Sprint(s, c.read); !strings.Contains(str, "<S:trace-2,") || !strings.Contains(str, "<c:trace-1,") {
+		t.Fatal(str)
+	}
+
+	c.SetLogTag("")
+	if str := c.String(); !strings.Contains(str, idx) {
+		t.Fatal(str)
+	}
+}
+
+func TestSetWriteBufferCap(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	d := NewDialer("tcp", ln.Addr().String(), WithMaxWriteBuffer(64<<10))
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	c := conn.(*ClientConn)
+
+	// Nothing is sent while paused, so the buffer stays full
+	d.Pause()
+	c.Write(make([]byte, 64<<10+1))
+	wrote := make(chan time.Time, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			c.Write(make([]byte, 10))
+			wrote <- time.Now()
+		}()
+	}
+	select {
+	case <-wrote:
+		t.Fatal("write not blocked")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Growing wakes all blocked writes
+	grown := time.Now()
+	c.SetWriteBufferCap(1 << 20)
+	for i := 0; i < 2; i++ {
+		select {
+		case at := <-wrote:
+			if at.Sub(grown) > 300*time.Millisecond {
+				t.Fatal("blocked write woken late: ", at.Sub(grown))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("blocked write not woken")
+		}
+	}
+	if _, err := c.Write(make([]byte, 100<<10)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shrinking keeps buffered data, but blocks further writes
+	c.SetWriteBufferCap(1 << 10)
+	c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := c.Write([]byte("!")); err == nil {
+		t.Fatal("wrote over the cap")
+	}
+	c.SetWriteDeadline(time.Time{})
+	total := 64<<10 + 1 + 2*10 + 100<<10
+	if n := c.WriteBufferedBytes(); n != total {
+		t.Fatal(n)
+	}
+
+	d.Resume()
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(sc, make([]byte, total)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetWriteBufferCap(0)
+	if n := c.writeBufferCap(); n != 64<<10 {
+		t.Fatal(n)
+	}
+}
+
+func TestEndFrameNegotiated(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	d := NewDialer("tcp", ln.Addr().String())
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	c := conn.(*ClientConn)
+	if !c.read.endFrame || !sc.(*ServerConn).read.endFrame {
+		t.Fatal("end frame not negotiated")
+	}
+
+	// A client unaware of end frames: its hello carries no flags, and its requests end by EOF
+	ctx := context.Background()
+	idx := c.idx + 1
+	hello := frame{idx: rand.Uint32(), connIdx: idx, options: optHello, data: append(newHelloData(), 1)}
+	if _, err := c.sendContext(ctx, frame{idx: rand.Uint32(), connIdx: idx, options: optSyncConnIdx, next: &hello}); err != nil {
+		t.Fatal(err)
+	}
+	old, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	if old.(*ServerConn).read.endFrame {
+		t.Fatal("end frame negotiated with an old client")
+	}
+	data := frame{idx: 1, connIdx: idx, data: []byte("hello")}
+	if _, err := c.sendContext(ctx, frame{idx: rand.Uint32(), connIdx: idx, options: optSyncConnIdx, next: &data}); err != nil {
+		t.Fatal(err)
+	}
+	old.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p := make([]byte, 5)
+	if _, err := io.ReadFull(old, p); err != nil || string(p) != "hello" {
+		t.Fatal(string(p), err)
+	}
+	if err, _ := old.(*ServerConn).read.status(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// crossNetworkControl sends control frames of d for the conn of another dialer, and checks none of them is honored
+func crossNetworkControl(t *testing.T, ln *Listener, d *Dialer, victim *ClientConn) {
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := conn.(*ClientConn)
+
+	ctx := context.Background()
+	for _, options := range []byte{optClosed, optReadClosed} {
+		resp, err := c.sendContext(ctx, frame{connIdx: victim.idx, options: options, version: c.read.version})
+		if err == nil {
+			f, ok := parseframe(resp.Body, d.blk)
+			resp.Body.Close()
+			if ok && f.options == options {
+				t.Fatal("control frame acknowledged: ", options)
+			}
+		}
+	}
+
+	idx := make([]byte, 8)
+	binary.BigEndian.PutUint64(idx, victim.idx)
+	resp, err := c.sendContext(ctx, frame{options: optPing, version: c.read.version, data: idx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := parseframe(resp.Body, d.blk)
+	resp.Body.Close()
+	if !ok || len(f.data) < 2 || binary.BigEndian.Uint16(f.data) != PING_CLOSED {
+		t.Fatal("ping answered: ", f)
+	}
+
+	// A hello taking the index over is rejected
+	hello := frame{idx: 1, connIdx: victim.idx, options: optHello, data: append(newHelloData(), 1)}
+	_, err = c.sendContext(ctx, frame{idx: 1, connIdx: victim.idx, options: optSyncConnIdx, next: &hello})
+	if se, ok := err.(*StatusError); !ok || se.Code != http.StatusForbidden {
+		t.Fatal("hello over an existing conn: ", err)
+	}
+
+	ln.connsmu.Lock()
+	sc := ln.conns[victim.idx]
+	ln.connsmu.Unlock()
+	if sc == nil || sc.read.closed || sc.write.dropped {
+		t.Fatal("conn of another network is affected")
+	}
+}
+
+func TestCrossNetworkIsolation(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0", WithNetwork("other", "/other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	go func() {
+		for {
+			if _, err := ln.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	crossNetworkControl(t, ln.(*Listener), NewDialer("other", ln.Addr().String(), WithPath("/other")), conn.(*ClientConn))
+
+	conn.Write([]byte("hello"))
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(sc, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCrossKeyIsolation(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ln.(*Listener).AddKey("old")
+
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	go func() {
+		for {
+			if _, err := ln.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	crossNetworkControl(t, ln.(*Listener), NewDialer("old", ln.Addr().String()), conn.(*ClientConn))
+}
+
+func TestConnEvents(t *testing.T) {
+	lnEvents, dEvents := make(chan ConnEvent, 4), make(chan ConnEvent, 4)
+	ln, err := Listen("tcp", "127.0.0.1:0", WithEvents(lnEvents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := NewDialer("tcp", ln.Addr().String(), WithEvents(dEvents)).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	idx := conn.(*ClientConn).idx
+	for _, events := range []chan ConnEvent{dEvents, lnEvents} {
+		for _, typ := range []string{"created", "closed"} {
+			select {
+			case e := <-events:
+				if e.Idx != idx || e.Type != typ || e.Time.IsZero() || (typ == "closed") != (e.Reason != "") {
+					t.Fatalf("%+v", e)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no event of ", typ)
+			}
+		}
+	}
+}
+
+func TestServerKey(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	other, _, _ := ed25519.GenerateKey(nil)
+
+	ln, err := Listen("tcp", "127.0.0.1:0", WithSigningKey(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	unsigned, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsigned.Close()
+
+	conn, err := NewDialer("tcp", ln.Addr().String(), WithServerKey(pub)).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if _, err := NewDialer("tcp", ln.Addr().String(), WithServerKey(other)).Dial(); err != ErrServerAuth {
+		t.Fatal(err)
+	}
+	if _, err := NewDialer("tcp", unsigned.Addr().String(), WithServerKey(pub)).Dial(); err != ErrServerAuth {
+		t.Fatal(err)
+	}
+}
+
+func TestHelloKey(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0", WithHelloKey("bootstrap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := NewDialer("tcp", ln.Addr().String(), WithHelloKey("bootstrap")).DialEarly(context.Background(), []byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 10)
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "tokenhello" {
+		t.Fatal(string(buf), err)
+	}
+
+	// Early data need the key on both sides, while hellos without them don't
+	if _, err := NewDialer("tcp", ln.Addr().String()).DialEarly(context.Background(), []byte("token")); err == nil {
+		t.Fatal("early data not encrypted by the hello key are accepted")
+	}
+	if conn, err := NewDialer("tcp", ln.Addr().String()).Dial(); err != nil {
+		t.Fatal(err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	big := bytes.Repeat([]byte("0123456789"), 20<<10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				req, err := ioutil.ReadAll(conn)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				switch string(req) {
+				case "hang":
+					return
+				case "fail":
+					conn.(*ServerConn).CloseWithError(1, "bad request")
+					return
+				case "big":
+					conn.Write(big)
+				default:
+					conn.Write(bytes.ToUpper(req))
+				}
+				conn.(*ServerConn).CloseWrite()
+			}(conn)
+		}
+	}()
+
+	d := NewDialer("tcp", ln.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Carried by the hello
+	if resp, err := d.RoundTrip(ctx, []byte("hello")); err != nil || string(resp) != "HELLO" {
+		t.Fatal(string(resp), err)
+	}
+	if resp, err := RoundTrip(ctx, "tcp", ln.Addr().String(), []byte("world")); err != nil || string(resp) != "WORLD" {
+		t.Fatal(string(resp), err)
+	}
+
+	// Too large for the hello
+	req := bytes.Repeat([]byte("a"), MaxEarlyData+1)
+	if resp, err := d.RoundTrip(ctx, req); err != nil || !bytes.Equal(resp, bytes.ToUpper(req)) {
+		t.Fatal(len(resp), err)
+	}
+
+	// Spanning several frames
+	if resp, err := d.RoundTrip(ctx, []byte("big")); err != nil || !bytes.Equal(resp, big) {
+		t.Fatal(len(resp), err)
+	}
+
+	if _, err := d.RoundTrip(ctx, []byte("fail")); err == nil {
+		t.Fatal("no error from the server")
+	} else if ce, ok := err.(*CloseError); !ok || ce.Code != 1 {
+		t.Fatal(err)
+	}
+
+	hang, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := d.RoundTrip(hang, []byte("hang")); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+
+	if n := len(d.Connections()); n != 0 {
+		t.Fatal("conns left open: ", n)
+	}
+}
+
+func TestFrameQueueOverflowError(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0", WithQueueSize(1, 1, OverflowError), WithMaxReadBacklog(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := NewDialer("tcp", ln.Addr().String(), WithFlushInterval(10*time.Millisecond)).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	s := sc.(*ServerConn)
+
+	// Nothing reads, the first frame exceeds the backlog, the second one fills the queue
+	for start := time.Now(); ; {
+		conn.Write([]byte("hello"))
+		time.Sleep(50 * time.Millisecond)
+		if err, _ := s.read.status(); err == ErrQueueFull {
+			break
+		} else if err != nil || time.Since(start) > 5*time.Second {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBufferedBytes(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	c, s := conn.(*ClientConn), sc.(*ServerConn)
+
+	// Nothing reads on either side, so the data stay in the read buffers once sent
+	conn.Write([]byte("hello"))
+	sc.Write([]byte("world!"))
+	// Unless sent already
+	if n := s.WriteBufferedBytes(); n != 0 && n != 6 {
+		t.Fatal(n)
+	}
+	if n := c.WriteBufferedBytes(); n != 0 && n != 5 {
+		t.Fatal(n)
+	}
+	for start := time.Now(); s.ReadBufferedBytes() != 5 || c.ReadBufferedBytes() != 6; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal(s.ReadBufferedBytes(), c.ReadBufferedBytes())
+		}
+	}
+	if n, st := c.WriteBufferedBytes(), c.Stats(); n != 0 || st.WriteBuffered != 0 || st.ReadBuffered != 6 {
+		t.Fatal(n, st.WriteBuffered, st.ReadBuffered)
+	}
+}
+
+func TestMaxConnAge(t *testing.T) {
+	closed := make(chan *ServerConn, 1)
+	ln, err := Listen("tcp", "127.0.0.1:0", WithMaxConnAge(300*time.Millisecond, 50*time.Millisecond),
+		WithOnClose(func(conn *ServerConn) { closed <- conn }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	l := ln.(*Listener)
+
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep the conn active, it is evicted anyway
+	go func() {
+		for i := 0; i < 10; i++ {
+			conn.Write([]byte("x"))
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	select {
+	case c := <-closed:
+		if c != sc {
+			t.Fatal("unexpected conn: ", c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("conn is not evicted")
+	}
+	if _, err := ioutil.ReadAll(sc); err != ErrConnMaxAge {
+		t.Fatal(err)
+	}
+	l.connsmu.Lock()
+	n := len(l.conns)
+	l.connsmu.Unlock()
+	if n != 0 || l.HTTPStats().Evictions != 1 {
+		t.Fatal("conns: ", n, ", evictions: ", l.HTTPStats().Evictions)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if _, err := NewDialer("udp", ln.Addr().String(), WithHandshakeRetry(3, time.Second)).Dial(); err != ErrAuthFailed {
+		t.Fatal(err)
+	}
+	if n := ln.(*Listener).HTTPStats().AuthFailures; n != 1 {
+		t.Fatal("retried: ", n)
+	}
+
+	// Camouflaged by OnBadRequest, the response can't be decrypted either
+	ln.(*Listener).OnBadRequest = func(w http.ResponseWriter, r *http.Request) { w.Write(make([]byte, 64)) }
+	if _, err := NewDialer("udp", ln.Addr().String()).Dial(); err != ErrAuthFailed {
+		t.Fatal(err)
+	}
+}
+
+func TestRespQueueFull(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+		// Keep the client's response bodies coming
+		for i := 0; i < 64; i++ {
+			if _, err := conn.Write(make([]byte, 4<<10)); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	// The client never reads, so its response loop stalls on the backlog and the response queue fills
+	d := NewDialer("tcp", ln.Addr().String(), WithDirectSend(), WithMaxReadBacklog(1), func(d *Dialer, ln *Listener) {
+		if d != nil {
+			d.RespQueueSize, d.FrameQueueSize = 1, 1
+		}
+	})
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cc := conn.(*ClientConn)
+
+	written := 0
+	for start := time.Now(); len(cc.write.respCh) < cap(cc.write.respCh); written += 1 << 10 {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("response queue never filled")
+		}
+		if _, err := conn.Write(make([]byte, 1<<10)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Sends go on regardless
+	for i := 0; i < 16; i++ {
+		if _, err := conn.Write(make([]byte, 4<<10)); err != nil {
+			t.Fatal(err)
+		}
+		written += 4 << 10
+	}
+
+	sc := <-accepted
+	sc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if n, err := io.ReadFull(sc, make([]byte, written)); err != nil {
+		t.Fatal("received ", n, "/", written, ": ", err)
+	}
+	if !cc.Healthy() {
+		t.Fatal("conn failed")
+	}
+}
+
+// Run with -race, Healthy is called while the conn fails
+func TestHealthyConcurrent(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := conn.(*ClientConn)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.Healthy()
+			}
+		}()
+	}
+	c.read.feedError(fmt.Errorf("failed"))
+	wg.Wait()
+	if c.Healthy() {
+		t.Fatal("failed conn is healthy")
+	}
+}
+
+func TestServerKeepalive(t *testing.T) {
+	cfg := net.KeepAliveConfig{Idle: 30 * time.Second, Interval: 5 * time.Second, Count: 3}
+	ln, err := Listen("tcp", "127.0.0.1:0", WithServerKeepalive(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	cfg.Enable = true
+	if ka := ln.(*Listener).Keepalive; ka != cfg {
+		t.Fatal(ka)
+	}
+	conn, err := NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc.Close()
+}
+
+func TestShutdown(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	l := ln.(*Listener)
+
+	d := NewDialer("tcp", ln.Addr().String())
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- l.Shutdown(context.Background()) }()
+	for start := time.Now(); !l.DrainStatus().Draining; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("not draining")
+		}
+	}
+
+	// New conns are refused, existing ones keep working until closed
+	if _, err := d.Dial(); err == nil {
+		t.Fatal("dialed while draining")
+	}
+	conn.Write([]byte("hello"))
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(sc, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if s := l.DrainStatus(); s.Conns != 1 || s.OldestAge <= 0 {
+		t.Fatal(s)
+	}
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not drained")
+	}
+
+	// Conns left when ctx expires are closed
+	ln, err = Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err = NewDialer("tcp", ln.Addr().String()).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if sc, err = ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := ln.(*Listener).Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if _, err := sc.Read(make([]byte, 1)); err == nil {
+		t.Fatal("conn left open")
+	}
+}
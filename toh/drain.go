@@ -0,0 +1,86 @@
+package toh
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DrainStatus is the progress of Listener.Shutdown
+type DrainStatus struct {
+	Draining  bool
+	Conns     int           // conns which are yet to finish
+	Elapsed   time.Duration // time since Shutdown started
+	OldestAge time.Duration // age of the longest-lived remaining conn
+}
+
+// Shutdown stops accepting new conns (hellos will be answered with 503), waits for existing conns
+// to finish (closed by either side or purged), then closes the listener. If ctx expires first,
+// the remaining conns will be closed and ctx.Err() returned. The progress can be watched by DrainStatus
+func (l *Listener) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt64(&l.drainStart, 0, monotime()) {
+		return errClosedListener
+	}
+
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		if s := l.DrainStatus(); s.Conns == 0 {
+			vprint("listener drained in ", s.Elapsed)
+			return l.Close()
+		}
+
+		select {
+		case <-tick.C:
+		case <-l.done:
+			return errClosedListener
+		case <-ctx.Done():
+			l.connsmu.Lock()
+			conns := make([]*ServerConn, 0, len(l.conns))
+			for _, c := range l.conns {
+				conns = append(conns, c)
+			}
+			l.connsmu.Unlock()
+
+			vprint("listener drain timed out, closing ", len(conns), " conns")
+			for _, c := range conns {
+				c.Close()
+			}
+			l.Close()
+			return ctx.Err()
+		}
+	}
+}
+
+// DrainStatus returns the progress of Shutdown, it is cheap enough to be polled
+func (l *Listener) DrainStatus() DrainStatus {
+	start := atomic.LoadInt64(&l.drainStart)
+	if start == 0 {
+		return DrainStatus{}
+	}
+
+	now := time.Now()
+	s := DrainStatus{Draining: true, Elapsed: time.Duration(monotime() - start)}
+
+	l.connsmu.Lock()
+	s.Conns = len(l.conns)
+	for _, c := range l.conns {
+		if age := now.Sub(c.created); age > s.OldestAge {
+			s.OldestAge = age
+		}
+	}
+	l.connsmu.Unlock()
+	return s
+}
+
+// rejectDraining answers hellos during Shutdown, it returns false if the listener isn't draining
+func (l *Listener) rejectDraining(w http.ResponseWriter) bool {
+	if atomic.LoadInt64(&l.drainStart) == 0 {
+		return false
+	}
+	atomic.AddUint64(&l.httpStats.Non200, 1)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	return true
+}
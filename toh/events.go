@@ -0,0 +1,48 @@
+package toh
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ConnEvent is a lifecycle event of a conn, see CommonOptions.Events
+type ConnEvent struct {
+	Idx    uint64    `json:"idx"`
+	Type   string    `json:"type"` // one of: created, closed
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason,omitempty"` // why the conn has closed
+}
+
+// emit sends the event to Events without blocking, it is dropped if the channel is full
+func (d *CommonOptions) emit(idx uint64, typ, reason string) {
+	if d.Events == nil {
+		return
+	}
+	select {
+	case d.Events <- ConnEvent{Idx: idx, Type: typ, Time: time.Now(), Reason: reason}:
+	default:
+		atomic.AddUint64(&d.droppedEvents, 1)
+	}
+}
+
+// DroppedEvents returns the number of events dropped because Events was full
+func (d *CommonOptions) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&d.droppedEvents)
+}
+
+// closeReason describes why the conn has closed
+func (c *readConn) closeReason() string {
+	c.Lock()
+	defer c.Unlock()
+	switch {
+	case c.err != nil:
+		return c.err.Error()
+	case c.peerClosed && c.closeErr != nil:
+		return c.closeErr.Error()
+	case c.peerClosed:
+		return "closed by the remote"
+	case c.localClosed:
+		return "closed locally"
+	}
+	return "closed"
+}
@@ -0,0 +1,133 @@
+package toh
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// ErrTargetDenied is returned by DenyPrivateTargets for targets in private or local ranges
+var ErrTargetDenied = fmt.Errorf("target denied")
+
+// Forwarder serves HTTP proxy requests carried in the tunnel on the server side:
+// for CONNECT requests, it dials the target, responds "200 Connection Established" and relays both directions,
+// for other requests, it dials the target, forwards the request and relays the rest.
+// UDP associations (see Socks5) are served by relaying datagrams between the conn and a UDP socket
+type Forwarder struct {
+	// Dial dials the target, default: net.Dial
+	Dial func(network, address string) (net.Conn, error)
+
+	// ForwardedFor appends the client IP of the conn (see ServerConn.RemoteAddr) to X-Forwarded-For,
+	// and sets X-Forwarded-Proto of forwarded requests. Only the first request of a conn is rewritten,
+	// the rest are relayed as is. Enable it only if the backend trusts these headers
+	ForwardedFor bool
+
+	// TargetFilter is called with the requested "host:port" before dialing, it returns the target to dial
+	// instead, or an error to reject the request with 403. Datagrams of UDP associations are filtered too,
+	// rejected ones are dropped. DenyPrivateTargets can be used against SSRF. nil means all targets are allowed
+	TargetFilter func(target string) (string, error)
+}
+
+// DenyPrivateTargets is a TargetFilter rejecting loopback, private, link-local and unspecified addresses.
+// The host is resolved once and the target is rewritten to the checked IP, so it won't be resolved
+// to a different one when dialing
+func DenyPrivateTargets(target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+			ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+			return "", ErrTargetDenied
+		}
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// filter returns the target to dial, see TargetFilter
+func (f *Forwarder) filter(target string) (string, error) {
+	if f.TargetFilter == nil {
+		return target, nil
+	}
+	return f.TargetFilter(target)
+}
+
+// Serve handles a single conn accepted from the listener, it returns after the relay ends
+func (f *Forwarder) Serve(conn net.Conn) error {
+	down := NewBufConn(conn)
+	req, err := http.ReadRequest(down.Reader)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if req.Method == udpAssociateMethod {
+		return f.serveUDP(down)
+	}
+
+	host := req.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if req.Method == "CONNECT" {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+
+	if host, err = f.filter(host); err != nil {
+		vprint("forwarder: rejected target ", req.Host, ": ", err)
+		down.Write([]byte("HTTP/1.1 403 Forbidden\r\nConnection: close\r\n\r\n" + err.Error()))
+		conn.Close()
+		return err
+	}
+
+	dial := f.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+
+	up, err := dial("tcp", host)
+	if err != nil {
+		down.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n" + err.Error()))
+		conn.Close()
+		return err
+	}
+
+	if req.Method == "CONNECT" {
+		_, err = down.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	} else {
+		if f.ForwardedFor {
+			setForwarded(req, conn)
+		}
+		err = req.Write(up)
+	}
+	if err != nil {
+		conn.Close()
+		up.Close()
+		return err
+	}
+
+	Bridge(down, up)
+	return nil
+}
+
+func setForwarded(req *http.Request, conn net.Conn) {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP != nil {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			req.Header.Set("X-Forwarded-For", prior+", "+addr.IP.String())
+		} else {
+			req.Header.Set("X-Forwarded-For", addr.IP.String())
+		}
+	}
+
+	proto := "http"
+	if sc, ok := conn.(*ServerConn); ok && sc.proto != "" {
+		proto = sc.proto
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+}
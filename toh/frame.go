@@ -3,13 +3,12 @@ package toh
 import (
 	"bytes"
 	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"time"
-
-	"github.com/coyove/common/sched"
 )
 
 const (
@@ -17,26 +16,103 @@ const (
 	optHello
 	optPing
 	optClosed
+	optEnd       // marks the end of a frame stream, so truncation can be detected
+	optPlaintext // in hello, data frames of the conn will not be encrypted
+)
+
+// optBarrier is a combination of bits (all bits are taken), it never appears in data frames, see ClientConn.Barrier
+const optBarrier = optSyncConnIdx | optPing
+
+// optReadClosed tells the server to stop sending data, see ClientConn.CloseRead
+const optReadClosed = optClosed | optPing
+
+// Options of frames, see Listener.OnFrame. Bits below OptUser1 are reserved by the protocol,
+// OptUser1 and OptUser2 are never set by this package and free for extensions
+const (
+	OptSyncConnIdx = optSyncConnIdx // the request carries frames of a conn
+	OptHello       = optHello       // a new conn
+	OptPing        = optPing        // batched pings of conns
+	OptClosed      = optClosed      // the conn is closed by the other side
+	OptEnd         = optEnd         // the end of a frame stream
+	OptPlaintext   = optPlaintext   // in hello, data frames of the conn will not be encrypted
+	OptBarrier     = optBarrier     // waits for all data of the conn to be received
+	OptReadClosed  = optReadClosed  // the other side no longer reads the conn
+
+	OptUser1    = 1 << 6
+	OptUser2    = 1 << 7
+	OptUserMask = OptUser1 | OptUser2
 )
 
+// plainBlock marks frames which are not encrypted, but still framed and checksummed.
+// It can't authenticate anything, so it should never be used to parse the first frame of a request
+type plainBlock struct{}
+
+func (plainBlock) BlockSize() int          { return 16 }
+func (plainBlock) Encrypt(dst, src []byte) { copy(dst, src) }
+func (plainBlock) Decrypt(dst, src []byte) { copy(dst, src) }
+
+// errFrameAuth is returned when the frame can't be decrypted by any known key
+var errFrameAuth = fmt.Errorf("frame: invalid key")
+
+// errFrameVersion is returned when the frame is of an unknown format version
+var errFrameVersion = fmt.Errorf("frame: unsupported version")
+
+// frameVersion is the max frame format version supported, the version used by a conn is negotiated in hello.
+// The version nibble is stored in the highest 4 bits of the length field, frames written before
+// versioning have 0 there, which is treated as version 1.
+//
+// Version 1 uses the first 12 bytes of the header (data idx + connection id) as the GCM nonce,
+// version 2 prepends a random 12 bytes nonce to the ciphertext and authenticates the header as additional data, see IVStrategy
+const frameVersion = 2
+
+// nonceSize is the size of the random nonce of version 2 frames
+const nonceSize = 12
+
+// frameParsers parses the data following the header, indexed by the frame version
+var frameParsers = []func(header [20]byte, datalen int, r io.Reader, blk cipher.Block) (frame, error){
+	1: parseframeV1,
+	2: parseframeV2,
+}
+
+// endframe terminates a frame stream
+var endframe = frame{options: optEnd}
+
 type frame struct {
 	connIdx uint64
 	idx     uint32
 	options byte
+	version byte // 0 means the frame is written without the version nibble, for peers unaware of versions
 	future  bool
 	data    []byte
 	next    *frame
 }
 
-// connection id 8b | data idx 4b | data length 4b | hash 3b | option 1b
+// connection id 8b | data idx 4b | version 4bit + data length 28bit | hash 3b | option 1b
 func (f *frame) marshal(blk cipher.Block) io.Reader {
 	buf := [20]byte{}
 	binary.BigEndian.PutUint32(buf[:4], f.idx)
 	binary.BigEndian.PutUint64(buf[4:], f.connIdx)
 
-	gcm, _ := cipher.NewGCM(blk)
-	x := gcm.Seal(f.data[:0], buf[:12], f.data, nil)
-	binary.LittleEndian.PutUint32(buf[12:], uint32(len(x)))
+	var x []byte
+	if _, plain := blk.(plainBlock); plain {
+		x = make([]byte, len(f.data)+4)
+		copy(x, f.data)
+		binary.BigEndian.PutUint32(x[len(f.data):], crc32.ChecksumIEEE(f.data))
+	} else if f.version >= 2 {
+		// The nonce is random, the header (except the hash) is authenticated as additional data instead,
+		// so the data can't be moved under the header of another frame
+		gcm, _ := cipher.NewGCM(blk)
+		n := nonceSize + len(f.data) + gcm.Overhead()
+		binary.LittleEndian.PutUint32(buf[12:], uint32(n)|uint32(f.version)<<28)
+		buf[16] = f.options
+		x = make([]byte, nonceSize, n)
+		rand.Read(x)
+		x = gcm.Seal(x, x, f.data, buf[:17])
+	} else {
+		gcm, _ := cipher.NewGCM(blk)
+		x = gcm.Seal(f.data[:0], buf[:12], f.data, nil)
+	}
+	binary.LittleEndian.PutUint32(buf[12:], uint32(len(x))|uint32(f.version)<<28)
 	buf[16] = f.options
 
 	h := crc32.Checksum(buf[:17], crc32.IEEETable)
@@ -51,51 +127,125 @@ func (f *frame) marshal(blk cipher.Block) io.Reader {
 	return io.MultiReader(bytes.NewReader(buf[:]), bytes.NewReader(x), f.next.marshal(blk))
 }
 
+// size returns the total number of bytes of the frame chain after marshalling
+func (f *frame) size() int {
+	n := 0
+	for ; f != nil; f = f.next {
+		n += 20 + len(f.data) + 16 // header + data + gcm tag
+		if f.version >= 2 {
+			n += nonceSize
+		}
+	}
+	return n
+}
+
 func parseframe(r io.ReadCloser, blk cipher.Block) (f frame, ok bool) {
-	k := sched.Schedule(func() {
+	f, _, err := parseframeAny(r, blk)
+	return f, err == nil
+}
+
+// parseframeAny parses the frame using the first cipher block which can successfully decrypt the header,
+// errFrameAuth will be returned if none of them can
+func parseframeAny(r io.ReadCloser, blks ...cipher.Block) (f frame, blk cipher.Block, err error) {
+	k := schedule(func() {
 		vprint("[ParseFrame] waiting too long")
 		r.Close()
 	}, time.Minute)
 	defer k.Cancel()
 
-	header := [20]byte{}
-	if n, err := io.ReadAtLeast(r, header[:], len(header)); err != nil || n != len(header) {
+	raw := [20]byte{}
+	if _, err = io.ReadAtLeast(r, raw[:], len(raw)); err != nil {
 		if err == io.EOF {
-			ok = true
+			err = nil
 		} else {
 			vprint(err)
 		}
 		return
 	}
 
-	blk.Decrypt(header[4:], header[4:])
-	blk.Decrypt(header[:], header[:])
+	var header [20]byte
+	for _, b := range blks {
+		header = raw
+		b.Decrypt(header[4:], header[4:])
+		b.Decrypt(header[:], header[:])
 
-	h := crc32.Checksum(header[:17], crc32.IEEETable)
-	if header[17] != byte(h) || header[18] != byte(h>>8) || header[19] != byte(h>>16) {
-		vprint(header)
-		return
+		h := crc32.Checksum(header[:17], crc32.IEEETable)
+		if header[17] == byte(h) && header[18] == byte(h>>8) && header[19] == byte(h>>16) {
+			blk = b
+			break
+		}
 	}
 
-	datalen := int(binary.LittleEndian.Uint32(header[12:]))
-	data := make([]byte, datalen)
-	if n, err := io.ReadAtLeast(r, data, datalen); err != nil || n != datalen {
-		vprint(err)
-		return
+	if blk == nil {
+		vprint("undecryptable frame header: ", payloadOf(raw[:]))
+		return f, nil, errFrameAuth
 	}
 
-	gcm, err := cipher.NewGCM(blk)
-	data, err = gcm.Open(nil, header[:12], data, nil)
+	lv := binary.LittleEndian.Uint32(header[12:])
+	version := int(lv >> 28)
+	if version == 0 {
+		version = 1
+	}
+	if version >= len(frameParsers) || frameParsers[version] == nil {
+		vprint("frame version: ", version)
+		return f, nil, errFrameVersion
+	}
+
+	f, err = frameParsers[version](header, int(lv&0x0fffffff), r, blk)
 	if err != nil {
+		return f, nil, err
+	}
+	return f, blk, nil
+}
+
+func parseframeV1(header [20]byte, datalen int, r io.Reader, blk cipher.Block) (frame, error) {
+	return parseframeData(header, datalen, r, blk, false)
+}
+
+func parseframeV2(header [20]byte, datalen int, r io.Reader, blk cipher.Block) (frame, error) {
+	return parseframeData(header, datalen, r, blk, true)
+}
+
+// parseframeData reads and opens the data, whose nonce is either derived from the header or prepended to it
+func parseframeData(header [20]byte, datalen int, r io.Reader, blk cipher.Block, randomNonce bool) (f frame, err error) {
+	data := make([]byte, datalen)
+	if _, err = io.ReadAtLeast(r, data, datalen); err != nil {
 		vprint(err)
 		return
 	}
 
+	if _, plain := blk.(plainBlock); plain {
+		if len(data) < 4 || crc32.ChecksumIEEE(data[:len(data)-4]) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+			err = fmt.Errorf("frame: invalid checksum")
+			vprint(err)
+			return
+		}
+		data = data[:len(data)-4]
+	} else {
+		nonce, ad := header[:12], []byte(nil)
+		if randomNonce {
+			if len(data) < nonceSize {
+				err = fmt.Errorf("frame: missing nonce")
+				vprint(err)
+				return
+			}
+			nonce, data, ad = data[:nonceSize], data[nonceSize:], header[:17]
+		}
+		gcm, _ := cipher.NewGCM(blk)
+		// Decrypted in place, frames can be large
+		data, err = gcm.Open(data[:0], nonce, data, ad)
+		if err != nil {
+			vprint(err)
+			return
+		}
+	}
+
 	f.idx = binary.BigEndian.Uint32(header[:4])
 	f.connIdx = binary.BigEndian.Uint64(header[4:])
 	f.data = data
 	f.options = header[16]
-	return f, true
+	f.version = header[15] >> 4
+	return f, nil
 }
 
 func (f frame) String() string {
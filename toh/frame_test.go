@@ -3,6 +3,8 @@ package toh
 import (
 	"bytes"
 	"crypto/aes"
+	"crypto/cipher"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"testing"
@@ -65,3 +67,114 @@ func TestFrame(t *testing.T) {
 		}
 	}
 }
+
+func TestFrameTruncated(t *testing.T) {
+	blk, _ := aes.NewCipher(make([]byte, 16))
+
+	stream := func(end bool) io.ReadCloser {
+		f := &frame{idx: 1, connIdx: 1, data: []byte("hello")}
+		if end {
+			f.next = &endframe
+		}
+		return ioutil.NopCloser(f.marshal(blk))
+	}
+
+	c := newReadConn(1, blk, 'c', &CommonOptions{FrameQueueSize: 16})
+	if n, err := c.feedframes(stream(true)); err != nil || n != 5 {
+		t.Fatal(n, err)
+	}
+
+	// The body ends exactly between frames, without the end frame
+	c = newReadConn(1, blk, 'c', &CommonOptions{FrameQueueSize: 16})
+	c.endFrame = true
+	if _, err := c.feedframes(stream(false)); err != ErrTruncated {
+		t.Fatal(err)
+	}
+
+	// Peers which haven't negotiated end frames end their streams by EOF
+	c = newReadConn(1, blk, 'c', &CommonOptions{FrameQueueSize: 16})
+	if n, err := c.feedframes(stream(false)); err != nil || n != 5 {
+		t.Fatal(n, err)
+	}
+}
+
+func TestFrameVersion(t *testing.T) {
+	blk, _ := aes.NewCipher(make([]byte, 16))
+
+	// A parser aware of a future version, its frames have the data unencrypted
+	defer func(p []func([20]byte, int, io.Reader, cipher.Block) (frame, error)) { frameParsers = p }(frameParsers)
+	frameParsers = append(frameParsers[:frameVersion+1:frameVersion+1], func(header [20]byte, datalen int, r io.Reader, blk cipher.Block) (frame, error) {
+		f := frame{idx: 2, version: frameVersion + 1, data: make([]byte, datalen)}
+		_, err := io.ReadFull(r, f.data)
+		return f, err
+	})
+
+	for _, v := range []byte{0, 1, 2} {
+		f := &frame{idx: 1, connIdx: 1, version: v, data: []byte("v1")}
+		f2, ok := parseframe(ioutil.NopCloser(f.marshal(blk)), blk)
+		if !ok || f2.idx != 1 || string(f2.data) != "v1" || f2.version != v {
+			t.Fatal(v, f2)
+		}
+	}
+
+	f := &frame{idx: 1, connIdx: 1, version: frameVersion + 1, data: []byte("v3")}
+	if f2, ok := parseframe(ioutil.NopCloser(f.marshal(blk)), blk); !ok || f2.version != frameVersion+1 || f2.idx != 2 {
+		t.Fatal(f2)
+	}
+
+	f = &frame{idx: 1, connIdx: 1, version: frameVersion + 2, data: []byte("v4")}
+	if _, _, err := parseframeAny(ioutil.NopCloser(f.marshal(blk)), blk); err != errFrameVersion {
+		t.Fatal(err)
+	}
+}
+
+func TestFrameNonce(t *testing.T) {
+	blk, _ := aes.NewCipher(make([]byte, 16))
+
+	marshal := func(version byte) []byte {
+		f := &frame{idx: 1, connIdx: 1, version: version, data: []byte("nonce")}
+		buf, _ := ioutil.ReadAll(f.marshal(blk))
+		if len(buf) != f.size() {
+			t.Fatal(version, len(buf), f.size())
+		}
+		return buf
+	}
+
+	// Header derived nonces give the same ciphertext, random ones don't
+	if !bytes.Equal(marshal(1), marshal(1)) {
+		t.Fatal("derived nonce")
+	}
+	a, b := marshal(2), marshal(2)
+	if bytes.Equal(a[20:], b[20:]) {
+		t.Fatal("random nonce")
+	}
+
+	// Flipping a bit of the nonce breaks the authentication
+	a[20] ^= 1
+	if _, ok := parseframe(ioutil.NopCloser(bytes.NewReader(a)), blk); ok {
+		t.Fatal("tampered nonce")
+	}
+}
+
+func TestFrameHeaderSwap(t *testing.T) {
+	blk, _ := aes.NewCipher(make([]byte, 16))
+
+	marshal := func(connIdx uint64, options byte, version byte) []byte {
+		f := &frame{idx: 1, connIdx: connIdx, options: options, version: version, data: []byte("payload")}
+		buf, _ := ioutil.ReadAll(f.marshal(blk))
+		return buf
+	}
+	// Version 1 binds the data to the idx and conn by the nonce, version 2 to the whole header
+	others := map[byte][][]byte{
+		1: {marshal(2, 0, 1)},
+		2: {marshal(2, 0, 2), marshal(1, optClosed, 2)},
+	}
+	for version, headers := range others {
+		for _, other := range headers {
+			buf := append(append([]byte{}, other[:20]...), marshal(1, 0, version)[20:]...)
+			if f, ok := parseframe(ioutil.NopCloser(bytes.NewReader(buf)), blk); ok {
+				t.Fatal("data moved under another header: ", version, f)
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package toh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// unixNano returns 0 for the zero time
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// ConnState is the resumable state of a ClientConn
+type ConnState struct {
+	Idx          uint64 `json:"idx"`
+	ReadCounter  uint32 `json:"read_counter"`
+	WriteCounter uint32 `json:"write_counter"`
+	Endpoint     string `json:"endpoint"`
+	URLPath      string `json:"url_path"`
+	Pending      []byte `json:"pending"`             // bytes written but not sent yet
+	Version      byte   `json:"version"`             // negotiated frame version
+	EndFrame     bool   `json:"end_frame,omitempty"` // responses are terminated by the end frame
+
+	// Deadlines set by the caller in UnixNano, 0 if not set, see ClientConn.SetDeadline
+	ReadDeadline  int64 `json:"read_deadline,omitempty"`
+	WriteDeadline int64 `json:"write_deadline,omitempty"`
+
+	Unread []byte      `json:"unread,omitempty"` // bytes received but not read yet
+	Future []ConnFrame `json:"future,omitempty"` // frames which arrived ahead of missing ones
+
+	// Encryption of data frames negotiated by the hello, see Dialer.NoFrameEncryption and DataKey
+	Plaintext bool `json:"plaintext,omitempty"`
+	DataKey   bool `json:"data_key,omitempty"`
+}
+
+// ConnFrame is a received frame in ConnState
+type ConnFrame struct {
+	Idx     uint32 `json:"idx"`
+	Options byte   `json:"options"`
+	Data    []byte `json:"data"`
+}
+
+// Export detaches the connection and returns its state, which can be resumed by Dialer.Import in another process.
+// The server is not told about the export, so the conn must be imported before the server purges it.
+// Data received but not read yet are carried by the state, while data arriving between Export and Import
+// (responses which are in flight) will be lost, callers should stop writing and wait a while for
+// in flight responses before exporting
+func (c *ClientConn) Export() ([]byte, error) {
+	if c.read.closed {
+		return nil, errClosedConn
+	}
+
+	c.read.Lock()
+	future, err := c.read.exportFutureFrames()
+	if err != nil {
+		c.read.Unlock()
+		return nil, err
+	}
+	unread := c.read.buf.Take()
+	readCounter := c.read.counter
+	_, plaintext := c.read.blk.(plainBlock)
+	dataKey := c.read.blk == c.dialer.dataBlk
+	readDeadline := c.read.deadline
+	c.read.Unlock()
+
+	c.write.Lock()
+	c.write.sched.Cancel()
+	state := ConnState{
+		Idx:          c.idx,
+		WriteCounter: c.write.counter,
+		Endpoint:     c.dialer.endpoint,
+		URLPath:      c.dialer.URLPath,
+		Pending:      append([]byte{}, c.write.buf...),
+		Version:      c.read.version,
+		EndFrame:     c.read.endFrame,
+	}
+	c.write.buf, c.write.marks = c.write.buf[:0], c.write.marks[:0]
+	atomic.StoreInt64(&c.write.buffered, int64(len(c.write.buf)))
+	c.write.Unlock()
+
+	state.ReadCounter, state.Unread, state.Future = readCounter, unread, future
+	state.Plaintext, state.DataKey = plaintext, dataKey && !plaintext
+	state.ReadDeadline = unixNano(readDeadline)
+	state.WriteDeadline = unixNano(c.write.deadline.get())
+
+	// Close the conn locally, without sending optClosed
+	c.read.shutdown()
+	c.closeLocal()
+
+	return json.Marshal(state)
+}
+
+// exportFutureFrames returns the frames waiting in futureframes, those saved to disk are loaded and removed, c must be locked
+func (c *readConn) exportFutureFrames() ([]ConnFrame, error) {
+	var frames []ConnFrame
+	var saved []string
+	for idx, f := range c.futureframes {
+		if f.future {
+			buf, err := ioutil.ReadFile(frameTmpPath(c.idx, idx))
+			if err != nil {
+				return nil, fmt.Errorf("export: missing frame on disk: %v", err)
+			}
+			f.data = buf
+			saved = append(saved, frameTmpPath(c.idx, idx))
+		}
+		frames = append(frames, ConnFrame{Idx: idx, Options: f.options, Data: f.data})
+	}
+	for _, path := range saved {
+		os.Remove(path)
+	}
+	sort.Slice(frames, func(i, j int) bool { return frames[i].Idx < frames[j].Idx })
+	return frames, nil
+}
+
+// Import resumes a connection exported by ClientConn.Export, the dialer must share the same network and endpoint
+func (d *Dialer) Import(buf []byte) (net.Conn, error) {
+	var state ConnState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return nil, err
+	}
+
+	if state.Endpoint != d.endpoint || state.URLPath != d.URLPath {
+		return nil, fmt.Errorf("import: unmatched endpoint: %s%s", state.Endpoint, state.URLPath)
+	}
+
+	c := d.allocClientConn(state.Idx)
+	c.write.counter = state.WriteCounter
+	c.push(state.Pending, 0, true)
+	c.read.counter = state.ReadCounter
+	c.read.version = state.Version
+	c.read.endFrame = state.EndFrame
+	switch {
+	case state.Plaintext:
+		c.read.blk = plainBlock{}
+	case state.DataKey:
+		if d.dataBlk == nil {
+			return nil, fmt.Errorf("import: the conn is encrypted by DataKey")
+		}
+		c.read.blk = d.dataBlk
+	default:
+		c.read.blk = d.blk
+	}
+	c.read.buf.Write(state.Unread)
+	for _, f := range state.Future {
+		c.read.futureframes[f.Idx] = frame{idx: f.Idx, connIdx: c.idx, options: f.Options, data: f.Data}
+		c.read.futureSize += len(f.Data)
+	}
+	if state.ReadDeadline != 0 {
+		c.read.setReadDeadline(time.Unix(0, state.ReadDeadline))
+	}
+	if state.WriteDeadline != 0 {
+		c.write.deadline.set(time.Unix(0, state.WriteDeadline))
+	}
+	d.startClientConn(c)
+
+	return c, nil
+}
@@ -0,0 +1,91 @@
+package toh
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync/atomic"
+)
+
+// frameSizeBuckets are upper bounds of frame payload sizes, the last bucket is +Inf
+var frameSizeBuckets = []int{16, 64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+type sizeHistogram struct {
+	counts [10]uint64 // len(frameSizeBuckets) + 1
+	sum    uint64
+}
+
+func (h *sizeHistogram) observe(size int) {
+	i := 0
+	for i < len(frameSizeBuckets) && size > frameSizeBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, uint64(size))
+}
+
+func (h *sizeHistogram) snapshot() Histogram {
+	var s Histogram
+	for i := range h.counts {
+		s.Count += atomic.LoadUint64(&h.counts[i])
+		le := math.Inf(1)
+		if i < len(frameSizeBuckets) {
+			le = float64(frameSizeBuckets[i])
+		}
+		s.Buckets = append(s.Buckets, HistogramBucket{Le: le, Count: s.Count})
+	}
+	s.Sum = atomic.LoadUint64(&h.sum)
+	return s
+}
+
+// frameSizes records payload sizes of frames sent and received, nil means disabled
+type frameSizes struct {
+	sent, received sizeHistogram
+}
+
+func (s *frameSizes) observeSent(size int) {
+	if s != nil {
+		s.sent.observe(size)
+	}
+}
+
+func (s *frameSizes) observeReceived(size int) {
+	if s != nil {
+		s.received.observe(size)
+	}
+}
+
+func (s *frameSizes) snapshot() (sent, received Histogram) {
+	if s == nil {
+		return
+	}
+	return s.sent.snapshot(), s.received.snapshot()
+}
+
+// HistogramBucket is the number of observations less than or equal to Le, like Prometheus' buckets
+type HistogramBucket struct {
+	Le    float64
+	Count uint64
+}
+
+// Histogram is a snapshot of frame payload sizes. Buckets are cumulative, the last one is +Inf
+type Histogram struct {
+	Buckets []HistogramBucket
+	Count   uint64
+	Sum     uint64
+}
+
+// WritePrometheus writes the histogram in the Prometheus text format under the metric name
+func (h Histogram) WritePrometheus(w io.Writer, name string) error {
+	for _, b := range h.Buckets {
+		le := "+Inf"
+		if !math.IsInf(b.Le, 1) {
+			le = fmt.Sprint(b.Le)
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, le, b.Count); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s_sum %d\n%s_count %d\n", name, h.Sum, name, h.Count)
+	return err
+}
@@ -1,76 +1,168 @@
 package toh
 
 import (
+	"bufio"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var errClosedListener = fmt.Errorf("accept on closed listener")
+
 type Listener struct {
 	ln           net.Listener
 	closed       bool
+	closeOnce    sync.Once
+	done         chan struct{} // closed by Close
 	conns        map[uint64]*ServerConn
 	connsmu      sync.Mutex
-	httpServeErr chan error
+	serveErr     error         // why the HTTP server exited, sticky once serveDone is closed
+	serveDone    chan struct{} // closed when the HTTP server exits unexpectedly
+	serveOnce    sync.Once
 	pendingConns chan net.Conn
 	blk          cipher.Block
+	dataBlk      cipher.Block // see DataKey
+	helloBlk     cipher.Block // see HelloKey
+	network      string
+	networks     map[string]lnNetwork    // extra networks keyed by URL path
+	keys         map[string]cipher.Block // extra valid keys of the default network, for key rotation
+	keysmu       sync.RWMutex
+	httpStats    HTTPStats
+	replays      *replayCache
+	drainStart   int64 // monotime when Shutdown started
+	mux          http.Handler
+	budget       *memBudget // see MemoryLimit
 
+	// OnBadRequest answers bad requests instead of random bytes, including requests which can't be
+	// decrypted by any key, which are otherwise answered with 401 so dialers of other keys fail clearly
 	OnBadRequest http.HandlerFunc
+	HealthPath   string              // health check path for load balancers, default: /healthz
+	Keepalive    net.KeepAliveConfig // TCP keepalive of accepted connections, not enabled means the system default
+
+	// PushHold holds a response open for at most the duration, data written by ServerConn during
+	// the time will be pushed onto the response immediately, rather than waiting for the next poll.
+	// It should be shorter than the Timeout of dialers. 0 means responses return as soon as possible
+	PushHold time.Duration
+
+	// RequestTimeout limits the time of reading a whole request (headers and body), so stalled
+	// clients will be cut off. 0 means no limit
+	RequestTimeout time.Duration
+
+	// WebSocket accepts websocket upgrades, such conns are carried by the websocket rather than
+	// polling requests, see WSConn. Otherwise upgrade requests are treated as bad requests
+	WebSocket bool
+
+	// OnFrame is called with the options of every frame received, including the first frame of requests,
+	// connIdx is the conn which the frame belongs to. User bits (OptUserMask) are otherwise ignored
+	OnFrame func(connIdx uint64, options byte)
+
+	// OnServeError is called once when the HTTP server exits unexpectedly, the listener is dead then,
+	// Accept will keep returning the error. It is not called for Close
+	OnServeError func(err error)
+
+	// MemoryLimit is the max bytes of frames received by all conns but not read yet, see MemoryUsage.
+	// When exceeded, requests carrying data are answered with 503 and dialers will resend the data later,
+	// a request accepted before may still overshoot the limit by its size. 0 means no limit
+	MemoryLimit int64
+
+	// MaxConnAge evicts conns which have lived longer than the duration, however active they are, checked every
+	// SweepInterval (default: a tenth of MaxConnAge). Read of evicted conns returns ErrConnMaxAge. 0 means no limit
+	MaxConnAge    time.Duration
+	SweepInterval time.Duration
+
+	// OnClose is called once when a conn is released, whether closed by either side, by error, by inactivity
+	// or evicted. It is called synchronously and must not block
+	OnClose func(conn *ServerConn)
+
+	// SigningKey signs hello responses, so dialers with the public key as Dialer.ServerKey can tell the listener
+	// from a man in the middle holding the network key, e.g. an untrusted front-end which terminates TLS
+	SigningKey ed25519.PrivateKey
+
+	// AllowPlaintext accepts conns whose hellos negotiate unencrypted data frames (Dialer.NoFrameEncryption),
+	// otherwise such hellos are rejected, so dialers can't downgrade the listener
+	AllowPlaintext bool
 	CommonOptions
 }
 
-func (l *Listener) Close() error {
+// Close closes the listener, it never blocks and can be called multiple times,
+// only the first call will close the underlying listener and return its error
+func (l *Listener) Close() (err error) {
+	l.closeOnce.Do(func() {
+		l.closed = true
+		close(l.done)
+		if l.ln != nil {
+			err = l.ln.Close()
+		}
+	})
+	return
+}
+
+// serveFailed records the error once, unless the server exits because of Close,
+// any further Accept will return it
+func (l *Listener) serveFailed(err error) {
 	select {
-	case l.httpServeErr <- fmt.Errorf("accept on closed listener"):
+	case <-l.done:
+		return
+	default:
 	}
-	l.closed = true
-	return l.ln.Close()
+	l.serveOnce.Do(func() {
+		vprint("listener: http server exited: ", err)
+		l.serveErr = err
+		close(l.serveDone)
+		if l.OnServeError != nil {
+			l.OnServeError(err)
+		}
+	})
 }
 
 func (l *Listener) Addr() net.Addr {
+	if l.ln == nil {
+		return &net.TCPAddr{}
+	}
 	return l.ln.Addr()
 }
 
 func (l *Listener) Accept() (net.Conn, error) {
 	for {
 		select {
-		case err := <-l.httpServeErr:
-			return nil, err
+		case <-l.serveDone:
+			return nil, l.serveErr
 		case conn := <-l.pendingConns:
 			return conn, nil
+		case <-l.done:
+			return nil, errClosedListener
 		}
 	}
 }
 
 func Listen(network string, address string, options ...Option) (net.Listener, error) {
-	ln, err := net.Listen("tcp", address)
+	l := NewListener(network, options...)
+
+	lc := net.ListenConfig{KeepAliveConfig: l.Keepalive}
+	ln, err := lc.Listen(context.Background(), "tcp", address)
 	if err != nil {
 		return nil, err
 	}
-
-	l := &Listener{
-		ln:           ln,
-		httpServeErr: make(chan error, 1),
-		pendingConns: make(chan net.Conn, 1024),
-		conns:        map[uint64]*ServerConn{},
-	}
-
-	for _, o := range options {
-		o(nil, l)
-	}
-
-	l.check()
-
-	l.blk, _ = aes.NewCipher([]byte(network + "0123456789abcdef")[:16])
+	l.ln = ln
 
 	go func() {
-		mux := http.NewServeMux()
-		mux.HandleFunc("/", l.handler)
-		l.httpServeErr <- http.Serve(ln, mux)
+		srv := &http.Server{
+			Handler:           l.mux,
+			ReadHeaderTimeout: l.RequestTimeout,
+			ReadTimeout:       l.RequestTimeout,
+		}
+		l.serveFailed(srv.Serve(ln))
 	}()
 
 	if Verbose {
@@ -91,29 +183,366 @@ func Listen(network string, address string, options ...Option) (net.Listener, er
 	return l, nil
 }
 
+// NewListener returns a listener without its own socket, it should be served by an HTTP server
+// via Handler, e.g. registered in a Mux. Accept and Close work as usual, Close won't stop the server
+func NewListener(network string, options ...Option) *Listener {
+	l := &Listener{
+		serveDone:    make(chan struct{}),
+		done:         make(chan struct{}),
+		pendingConns: make(chan net.Conn, 1024),
+		conns:        map[uint64]*ServerConn{},
+		network:      network,
+		networks:     map[string]lnNetwork{},
+		keys:         map[string]cipher.Block{},
+		replays:      newReplayCache(65536, helloWindow),
+	}
+
+	for _, o := range options {
+		o(nil, l)
+	}
+
+	l.check()
+	if l.MemoryLimit > 0 {
+		l.budget = &memBudget{limit: l.MemoryLimit}
+	}
+	if l.HealthPath == "" {
+		l.HealthPath = "/healthz"
+	}
+	if l.MaxConnAge > 0 {
+		if l.SweepInterval <= 0 {
+			l.SweepInterval = l.MaxConnAge / 10
+		}
+		go l.sweep()
+	}
+
+	l.blk = newBlock(network)
+	if l.DataKey != "" {
+		l.dataBlk = newDataBlock(network, l.DataKey)
+	}
+	if l.HelloKey != "" {
+		l.helloBlk = newDataBlock(network, l.HelloKey)
+	}
+	for path, n := range l.networks {
+		if l.DataKey != "" {
+			n.data = newDataBlock(n.name, l.DataKey)
+		}
+		if l.HelloKey != "" {
+			n.hello = newDataBlock(n.name, l.HelloKey)
+		}
+		l.networks[path] = n
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", l.handler)
+	mux.HandleFunc(l.HealthPath, l.healthHandler)
+	l.mux = mux
+	return l
+}
+
+// Handler returns the HTTP handler serving the tunnel and the health check
+func (l *Listener) Handler() http.Handler {
+	return l.mux
+}
+
+// lnNetwork is a logical network served by the listener, it has its own key
+type lnNetwork struct {
+	name  string
+	blk   cipher.Block
+	data  cipher.Block // nil unless DataKey is set
+	hello cipher.Block // nil unless HelloKey is set
+}
+
+func newBlock(network string) cipher.Block {
+	blk, _ := aes.NewCipher([]byte(network + "0123456789abcdef")[:16])
+	return blk
+}
+
+// newDataBlock derives a key from the network and DataKey (or HelloKey),
+// so networks sharing a DataKey still have their own data keys
+func newDataBlock(network, key string) cipher.Block {
+	sum := sha256.Sum256([]byte(network + "\x00" + key))
+	blk, _ := aes.NewCipher(sum[:16])
+	return blk
+}
+
+// dataBlock returns the block encrypting data frames once the hello is acknowledged
+func (d *Dialer) dataBlock() cipher.Block {
+	if d.NoFrameEncryption {
+		return plainBlock{}
+	}
+	if d.dataBlk != nil {
+		return d.dataBlk
+	}
+	return d.blk
+}
+
+// networkOf returns the logical network the request belongs to, by its URL path
+func (l *Listener) networkOf(path string) (lnNetwork, bool) {
+	if n, ok := l.networks[path]; ok {
+		return n, true
+	}
+	if l.URLPath != "" && path != l.URLPath {
+		return lnNetwork{}, false
+	}
+	return lnNetwork{name: l.network, blk: l.blk, data: l.dataBlk, hello: l.helloBlk}, true
+}
+
+// HTTPStats are counters of the HTTP requests served by the listener
+type HTTPStats struct {
+	Requests      uint64 `json:"requests"`       // total requests
+	Non200        uint64 `json:"non_200"`        // responses with non-200 status code
+	BadRequests   uint64 `json:"bad_requests"`   // requests answered by randomReply or OnBadRequest
+	Malformed     uint64 `json:"malformed"`      // requests with malformed frames
+	AuthFailures  uint64 `json:"auth_failures"`  // requests with frames which can't be decrypted
+	ClockSkews    uint64 `json:"clock_skews"`    // hellos rejected because their timestamps are out of the window, see helloWindow
+	MemoryRejects uint64 `json:"memory_rejects"` // requests rejected by MemoryLimit
+	Evictions     uint64 `json:"evictions"`      // conns evicted by MaxConnAge
+}
+
+func (l *Listener) HTTPStats() HTTPStats {
+	return HTTPStats{
+		Requests:      atomic.LoadUint64(&l.httpStats.Requests),
+		Non200:        atomic.LoadUint64(&l.httpStats.Non200),
+		BadRequests:   atomic.LoadUint64(&l.httpStats.BadRequests),
+		Malformed:     atomic.LoadUint64(&l.httpStats.Malformed),
+		AuthFailures:  atomic.LoadUint64(&l.httpStats.AuthFailures),
+		ClockSkews:    atomic.LoadUint64(&l.replays.skews),
+		MemoryRejects: atomic.LoadUint64(&l.httpStats.MemoryRejects),
+		Evictions:     atomic.LoadUint64(&l.httpStats.Evictions),
+	}
+}
+
+// AddKey adds an extra valid key to the default network of the listener, clients using either
+// the original key or any of the extra keys will be accepted. This enables key rotation without dropping sessions
+func (l *Listener) AddKey(network string) {
+	l.keysmu.Lock()
+	l.keys[network] = newBlock(network)
+	l.keysmu.Unlock()
+}
+
+// RemoveKey removes an extra key added by AddKey
+func (l *Listener) RemoveKey(network string) {
+	l.keysmu.Lock()
+	delete(l.keys, network)
+	l.keysmu.Unlock()
+}
+
+// blocksOf returns all valid cipher blocks of the network, the primary one comes first
+func (l *Listener) blocksOf(n lnNetwork) []cipher.Block {
+	blks := []cipher.Block{n.blk}
+	if n.name != l.network {
+		return blks
+	}
+
+	l.keysmu.RLock()
+	for _, blk := range l.keys {
+		blks = append(blks, blk)
+	}
+	l.keysmu.RUnlock()
+	return blks
+}
+
 type Dialer struct {
 	endpoint string
 	orch     chan *ClientConn
 	blk      cipher.Block
+	dataBlk  cipher.Block // see DataKey
+	helloBlk cipher.Block // see HelloKey
+	conns    map[uint64]*ClientConn
+	pausemu  sync.Mutex
+	resumed  chan struct{} // non-nil while paused, closed by Resume
+	connsmu  sync.Mutex
+	workers  *goPool
+	dialSem  chan struct{} // see MaxConcurrentDials
+	readers  sync.Pool     // *bufio.Reader of ReadBufferSize
+
+	orchWorkers   *goPool // batched pings of the orchestrator, see MaxOrchWorkers
+	orchTruncated uint64
+	orchFallbacks uint64
+
+	poolHits, poolMisses uint64
 
 	Transport http.RoundTripper
-	WebSocket bool
+
+	// HTTPClient sends all tunnel requests if set, Transport and the limits below are ignored then.
+	// Its Timeout applies to every request instead of the one derived from Timeout and the frame size,
+	// the request context is still canceled when the conn is closed, whichever comes first ends the request
+	HTTPClient *http.Client
+
+	// Limits of the transport created by the dialer, they have no effect if Transport is provided.
+	// All requests go to the same endpoint, so the per host idle limit matters most for busy tunnels:
+	// too few idle conns make the dialer open a new TCP (TLS) connection for most requests.
+	// Defaults: MaxIdleConns 100, MaxIdleConnsPerHost 32, MaxConnsPerHost 0 (no limit), IdleConnTimeout 90s
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+	WebSocket           bool
+
+	// BaseTimeout and BytesPerSecondFloor define the timeout of a single request:
+	// BaseTimeout + payload size / BytesPerSecondFloor, if BaseTimeout is 0, Timeout will be used
+	BaseTimeout         time.Duration
+	BytesPerSecondFloor int
+
+	MaxSendWorkers int // max number of goroutines sending requests, default: 1024
+
+	// MaxOrchWorkers is the max number of batched pings in flight, the orchestrator waits when it is reached,
+	// so slow responses won't pile up goroutines. Sends triggered by pings are still bound by MaxSendWorkers.
+	// Default: 64
+	MaxOrchWorkers int
+	// OrchQueueSize is the number of polling conns which can be queued for the orchestrator, conns polling
+	// when it is full are sent directly without batching, see DialerStats.OrchFallbacks. Default: 128
+	OrchQueueSize int
+
+	// ClientDriven stops polling the server after the connection has been idle for the duration,
+	// polling resumes when Write or Poll is called. Server initiated data won't arrive while idle,
+	// so it only suits protocols where the client always writes first
+	ClientDriven time.Duration
+
+	// OrchWindow is the time the orchestrator collects polling conns before batching their pings, default: 50ms
+	OrchWindow time.Duration
+	// OrchIdleMin and OrchIdleMax bound how long the orchestrator sleeps when no conn is polling, the sleep
+	// grows with the time since conns were last active, so the first poll after a brief pause isn't delayed
+	// much, while a dialer idle for long doesn't wake up often. Default: 10ms and 200ms
+	OrchIdleMin time.Duration
+	OrchIdleMax time.Duration
+	// DirectSend bypasses the orchestrator, every poll will be a separate request
+	DirectSend bool
+
+	// MaxRequestRate limits the number of data requests per second of a single conn, 0 means no limit
+	MaxRequestRate float64
+
+	// NoFrameEncryption disables encryption of data frames, it is negotiated in hello and the listener must
+	// allow it (Listener.AllowPlaintext). This is only reasonable when the tunnel runs over a trusted TLS connection
+	NoFrameEncryption bool
+
+	// FlushInterval is the max time buffered data will wait before being sent, default (or if <= 0): 1s
+	FlushInterval time.Duration
+
+	// HandshakeAttempts is the number of hello attempts before Dial fails, default: 1
+	HandshakeAttempts int
+	HandshakeBackoff  time.Duration
+
+	// Backoff decides the delays before retrying hellos and sends, it overrides HandshakeBackoff.
+	// If not set, sends are retried immediately
+	Backoff Backoff
+
+	// OnSendSizeEvent is called when the adaptive pending size of a conn saturates or collapses
+	OnSendSizeEvent func(old, new int)
+
+	// OnSendError is called on every failed attempt of sending buffered data, attempt starts from 1
+	OnSendError func(attempt int, err error)
+
+	// OnResponseHeaders is called with the headers of every 200 response to the conns' requests, e.g. to log
+	// the request IDs added by the CDN in front of the listener. The headers must not be modified
+	OnResponseHeaders func(http.Header)
+
+	// FailureThreshold fails a conn after the number of consecutive failed attempts, counted across sends and
+	// reset by any successful one, rather than after retrying a send for Timeout. 0 means by Timeout only
+	FailureThreshold int
+
+	// MaxConcurrentDials limits the number of handshakes in flight, the rest of Dial calls will wait in queue.
+	// 0 means no limit
+	MaxConcurrentDials int
+
+	// TLSConfig makes the dialer talk HTTPS to the endpoint. If its ClientSessionCache is nil, a cache will be set,
+	// so new TLS connections (e.g. after idle ones are closed, or the network changes) resume previous sessions
+	// rather than doing full handshakes. It has no effect on the transport if Transport is provided
+	TLSConfig *tls.Config
+
+	// ReadBufferSize is the size of the buffer reading response bodies, larger ones mean fewer reads
+	// for download heavy tunnels, default: 32K
+	ReadBufferSize int
+
+	// ClientVersion is a short string describing the client, e.g. "myapp/1.2.0", carried in hellos for diagnostics.
+	// The server logs it and exposes it by ServerConn.ClientVersion, at most MaxClientVersion bytes are sent
+	ClientVersion string
+
+	// ServerKey is the public key of Listener.SigningKey, Dial fails with ErrServerAuth if the hello response
+	// isn't signed by it. It proves the listener has answered the hello, so whoever holds the network key can't
+	// impersonate it. Only the handshake is signed though, an intermediary relaying the requests can still read
+	// frames encrypted by the network key, a DataKey unknown to it keeps the data away
+	ServerKey ed25519.PublicKey
 	CommonOptions
 }
 
 func NewDialer(network string, endpoint string, options ...Option) *Dialer {
 	d := &Dialer{
 		endpoint: endpoint,
-		orch:     make(chan *ClientConn, 128),
+		conns:    map[uint64]*ClientConn{},
 	}
-	d.blk, _ = aes.NewCipher([]byte(network + "0123456789abcdef")[:16])
+	d.blk = newBlock(network)
 
 	for _, o := range options {
 		o(d, nil)
 	}
 
+	if d.DataKey != "" {
+		d.dataBlk = newDataBlock(network, d.DataKey)
+	}
+	if d.HelloKey != "" {
+		d.helloBlk = newDataBlock(network, d.HelloKey)
+	}
+	if d.MaxIdleConns == 0 {
+		d.MaxIdleConns = 100
+	}
+	if d.MaxIdleConnsPerHost == 0 {
+		d.MaxIdleConnsPerHost = 32
+	}
+	if d.IdleConnTimeout == 0 {
+		d.IdleConnTimeout = 90 * time.Second
+	}
+	if d.TLSConfig != nil && d.TLSConfig.ClientSessionCache == nil {
+		d.TLSConfig = d.TLSConfig.Clone()
+		d.TLSConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
 	if d.Transport == nil {
-		d.Transport = http.DefaultTransport
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.MaxIdleConns = d.MaxIdleConns
+		tr.MaxIdleConnsPerHost = d.MaxIdleConnsPerHost
+		tr.MaxConnsPerHost = d.MaxConnsPerHost
+		tr.IdleConnTimeout = d.IdleConnTimeout
+		if d.TLSConfig != nil {
+			tr.TLSClientConfig = d.TLSConfig
+		}
+		d.Transport = tr
+	}
+	if d.FlushInterval <= 0 {
+		d.FlushInterval = time.Second
+	}
+	if d.HandshakeAttempts <= 0 {
+		d.HandshakeAttempts = 1
+	}
+	if d.OrchWindow == 0 {
+		d.OrchWindow = 50 * time.Millisecond
+	}
+	if d.OrchIdleMin == 0 {
+		d.OrchIdleMin = 10 * time.Millisecond
+	}
+	if d.OrchIdleMax == 0 {
+		d.OrchIdleMax = 200 * time.Millisecond
+	}
+	if d.OrchIdleMax < d.OrchIdleMin {
+		d.OrchIdleMax = d.OrchIdleMin
+	}
+	if d.MaxSendWorkers == 0 {
+		d.MaxSendWorkers = 1024
+	}
+	d.workers = newGoPool(d.MaxSendWorkers)
+	if d.MaxOrchWorkers == 0 {
+		d.MaxOrchWorkers = 64
+	}
+	d.orchWorkers = newGoPool(d.MaxOrchWorkers)
+	if d.OrchQueueSize <= 0 {
+		d.OrchQueueSize = 128
+	}
+	d.orch = make(chan *ClientConn, d.OrchQueueSize)
+	if d.ReadBufferSize == 0 {
+		d.ReadBufferSize = 32 << 10
+	}
+	d.readers.New = func() interface{} { return bufio.NewReaderSize(nil, d.ReadBufferSize) }
+	if d.MaxConcurrentDials > 0 {
+		d.dialSem = make(chan struct{}, d.MaxConcurrentDials)
 	}
 	if !d.WebSocket {
 		d.startOrch()
@@ -122,3 +551,73 @@ func NewDialer(network string, endpoint string, options ...Option) *Dialer {
 
 	return d
 }
+
+// FrameSizes returns histograms of payload sizes of data frames sent and received by the listener,
+// they are empty unless FrameSizeHistogram is enabled
+func (l *Listener) FrameSizes() (sent, received Histogram) {
+	return l.sizes.snapshot()
+}
+
+// FrameSizes returns histograms of payload sizes of data frames sent and received by the dialer,
+// they are empty unless FrameSizeHistogram is enabled
+func (d *Dialer) FrameSizes() (sent, received Histogram) {
+	return d.sizes.snapshot()
+}
+
+type DialerStats struct {
+	Conns          int `json:"conns"`           // number of active connections
+	Goroutines     int `json:"goroutines"`      // number of running send goroutines
+	OrchGoroutines int `json:"orch_goroutines"` // number of batched pings in flight
+
+	// OrchTruncated is the number of batched pings whose responses didn't answer all conns in the batch,
+	// the unanswered ones were sent directly
+	OrchTruncated uint64 `json:"orch_truncated"`
+	// OrchFallbacks is the number of polls sent directly because the orchestrator's queue was full,
+	// frequent ones mean OrchQueueSize is too small for the number of conns
+	OrchFallbacks uint64 `json:"orch_fallbacks"`
+
+	// Tunnel requests which reused an idle HTTP connection of the transport (hits),
+	// or had to open a new one (misses). Tunnel conns themselves are never pooled
+	PoolHits   uint64 `json:"pool_hits"`
+	PoolMisses uint64 `json:"pool_misses"`
+}
+
+func (d *Dialer) gotConn(info httptrace.GotConnInfo) {
+	if info.Reused {
+		atomic.AddUint64(&d.poolHits, 1)
+	} else {
+		atomic.AddUint64(&d.poolMisses, 1)
+	}
+}
+
+// Connections returns stats of all active connections, ordered by idx. Along with Stats,
+// they can be marshalled to JSON directly, e.g. for a debug endpoint
+func (d *Dialer) Connections() []ConnStats {
+	d.connsmu.Lock()
+	conns := make([]*ClientConn, 0, len(d.conns))
+	for _, c := range d.conns {
+		conns = append(conns, c)
+	}
+	d.connsmu.Unlock()
+
+	stats := make([]ConnStats, len(conns))
+	for i, c := range conns {
+		stats[i] = c.Stats()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Idx < stats[j].Idx })
+	return stats
+}
+
+func (d *Dialer) Stats() DialerStats {
+	d.connsmu.Lock()
+	defer d.connsmu.Unlock()
+	return DialerStats{
+		Conns:          len(d.conns),
+		Goroutines:     d.workers.Running(),
+		OrchGoroutines: d.orchWorkers.Running(),
+		OrchTruncated:  atomic.LoadUint64(&d.orchTruncated),
+		OrchFallbacks:  atomic.LoadUint64(&d.orchFallbacks),
+		PoolHits:       atomic.LoadUint64(&d.poolHits),
+		PoolMisses:     atomic.LoadUint64(&d.poolMisses),
+	}
+}
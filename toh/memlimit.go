@@ -0,0 +1,54 @@
+package toh
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrMemoryLimit is returned when frames are rejected because the listener's MemoryLimit is exceeded
+var ErrMemoryLimit = fmt.Errorf("memory limit exceeded")
+
+// memBudget is shared by all conns of a listener, it counts bytes of frames received but not read yet
+type memBudget struct {
+	limit int64
+	used  int64
+}
+
+func (b *memBudget) exceeded() bool {
+	return b != nil && atomic.LoadInt64(&b.used) >= b.limit
+}
+
+// hold counts n more (or less if negative) bytes buffered by the conn against the budget
+func (c *readConn) hold(n int) {
+	if c.budget == nil || n == 0 {
+		return
+	}
+	c.budgetmu.Lock()
+	if !c.released {
+		c.held += int64(n)
+		atomic.AddInt64(&c.budget.used, int64(n))
+	}
+	c.budgetmu.Unlock()
+}
+
+// releaseBudget returns all bytes held by the conn to the budget, data still buffered are no longer counted
+func (c *readConn) releaseBudget() {
+	if c.budget == nil {
+		return
+	}
+	c.budgetmu.Lock()
+	if !c.released {
+		c.released = true
+		atomic.AddInt64(&c.budget.used, -c.held)
+		c.held = 0
+	}
+	c.budgetmu.Unlock()
+}
+
+// MemoryUsage returns bytes of frames received by all conns but not read yet, it is 0 unless MemoryLimit is set
+func (l *Listener) MemoryUsage() int64 {
+	if l.budget == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.budget.used)
+}
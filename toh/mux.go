@@ -0,0 +1,55 @@
+package toh
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Mux routes requests to listeners by the Host header, so multiple tunnel networks, each with its own key
+// and accepted conns, can share one HTTP server (virtual hosting). Listeners should be created by NewListener
+type Mux struct {
+	mu    sync.RWMutex
+	hosts map[string]*Listener
+
+	// NotFound serves requests of unknown hosts, default: http.NotFound
+	NotFound http.Handler
+}
+
+func NewMux() *Mux {
+	return &Mux{hosts: map[string]*Listener{}}
+}
+
+// Handle registers the listener for the host, the port is ignored when matching, a nil listener removes the host
+func (m *Mux) Handle(host string, l *Listener) {
+	host = muxHost(host)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l == nil {
+		delete(m.hosts, host)
+	} else {
+		m.hosts[host] = l
+	}
+}
+
+func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.RLock()
+	l := m.hosts[muxHost(r.Host)]
+	m.mu.RUnlock()
+
+	if l != nil {
+		l.Handler().ServeHTTP(w, r)
+	} else if m.NotFound != nil {
+		m.NotFound.ServeHTTP(w, r)
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func muxHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
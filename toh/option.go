@@ -1,7 +1,10 @@
 package toh
 
 import (
+	"crypto/ed25519"
+	"crypto/tls"
 	"io"
+	"net"
 	"net/http"
 	"time"
 )
@@ -10,6 +13,90 @@ type CommonOptions struct {
 	URLPath        string
 	MaxWriteBuffer int
 	Timeout        time.Duration
+
+	// TimeoutJitter shortens the time each conn retries sending before it fails, which is about Timeout, by a random
+	// fraction up to TimeoutJitter (at most 1), so conns failing in a common outage don't fail and reconnect at once
+	TimeoutJitter float64
+
+	// DefaultReadTimeout applies to Read when no read deadline is set, 0 means blocking forever
+	DefaultReadTimeout time.Duration
+
+	// FrameQueueSize is the capacity of incoming frames waiting to be rearranged, default: 1024
+	FrameQueueSize int
+	// MaxReadBacklog is the max bytes received but not read yet. When exceeded, frames stop being rearranged
+	// until Read catches up, so the frame queue fills and reading of response (request) bodies blocks, which
+	// in turn slows down the sender through the HTTP connection. On the listener, a request blocked for
+	// long will fail on the dialer's Timeout. 0 means no limit, the read buffer grows with the backlog
+	MaxReadBacklog int
+	// RespQueueSize is the capacity of response bodies waiting to be read by the dialer, default: 128.
+	// Sending never waits on the queue, a body that doesn't fit is handled by OverflowPolicy
+	RespQueueSize int
+	// OverflowPolicy decides what to do when the above queues are full:
+	//   OverflowBlock: wait until the frame queue has space, process the response body in a new goroutine,
+	//                  which holds its HTTP connection until then
+	//   OverflowError: fail the conn with ErrQueueFull
+	OverflowPolicy byte
+
+	// NonBlockingWrite makes Write return ErrBufferFull immediately when the write buffer exceeds MaxWriteBuffer,
+	// rather than waiting for it to be drained. Callers must handle the temporary error and retry the write
+	NonBlockingWrite bool
+
+	// ReadCoalesce makes Read wait up to the duration for more data when the buffered data can't fill
+	// the caller's buffer, trading a little latency for fewer, larger reads. The read deadline still applies
+	ReadCoalesce time.Duration
+
+	// RingReadBuffer uses a ring buffer of the size as the read buffer to reduce allocations,
+	// it only grows when incoming data exceeds its capacity. 0 means using a plain slice
+	RingReadBuffer int
+
+	// Unordered delivers incoming data as soon as they arrive, without waiting for earlier frames,
+	// so a delayed frame won't block the others. Bytes from Read may be out of the order they were written,
+	// though each frame stays intact. Only use it when the application tolerates reordering
+	Unordered bool
+
+	// ReorderTimeout fails the conn with ErrReorderTimeout if a missing frame doesn't arrive in the duration
+	// while later frames have, so a lost frame won't stall the stream forever. 0 means waiting forever
+	ReorderTimeout time.Duration
+
+	// IVStrategy decides how GCM nonces of frames are chosen: IVRandom prepends a random nonce to each frame,
+	// IVDerived uses the data idx and connection id of the header as the nonce, so the same frame is always
+	// encrypted to the same bytes, which is only meant for debugging. A derived nonce repeats across
+	// directions, retries and reconnects of the same conn, GCM with a repeated nonce leaks the XOR of
+	// the plaintexts and lets the key for authentication be recovered, so a static IV is never safe.
+	// The strategy is negotiated in hello, IVDerived on either side wins
+	IVStrategy byte
+
+	// DataKey encrypts data frames with a key derived from it and the network, while the network key still
+	// encrypts control frames: hellos, pings and the first frame of every request, which carry conn ids, counters
+	// and states. It is meant for deployments where the network key is shared more widely than the payload
+	// should be, e.g. by front-ends inspecting or routing the tunnel: holding the network key alone reveals
+	// which conns exist and how they behave, but not what they carry. It doesn't keep a holder of the network
+	// key from disrupting conns, and early data of DialEarly are still encrypted by the network key like the hello,
+	// unless HelloKey is set. Empty means one key for both. It is negotiated in hello, the listener rejects dialers
+	// whose DataKey is set while its own isn't, or the opposite, unless NoFrameEncryption is set
+	DataKey string
+
+	// HelloKey encrypts early data of DialEarly with a key derived from it and the network, rather than the
+	// network key which still encrypts the hello itself, so bootstrap secrets carried by early data, e.g. a session
+	// token, stay secret where the network key is kept in a less trusted config. It should be provisioned apart from
+	// the network key, e.g. from a secret store, to the dialers and the listener only, a change needs both sides
+	// updated, as the listener rejects early data if only one side has it. The frames after the hello are not
+	// affected, see DataKey for them
+	HelloKey string
+
+	// FrameSizeHistogram records payload sizes of frames sent and received, see FrameSizes of Dialer and Listener
+	FrameSizeHistogram bool
+	sizes              *frameSizes
+
+	// Events receives lifecycle events of conns, i.e. created and closed ones, as a push-based alternative to
+	// polling Connections. Events are sent without blocking, they are dropped when the channel is full,
+	// see DroppedEvents, so the channel should be buffered
+	Events        chan<- ConnEvent
+	droppedEvents uint64
+
+	// Methods are HTTP methods used by tunnel requests, the dialer picks one randomly for each request,
+	// the listener rejects requests of other methods. For GET, the payload is carried in a header. Default: POST
+	Methods []string
 }
 
 func (d *CommonOptions) check() {
@@ -19,8 +106,47 @@ func (d *CommonOptions) check() {
 	if d.MaxWriteBuffer == 0 {
 		d.MaxWriteBuffer = 1024 * 1024
 	}
+	if d.FrameQueueSize == 0 {
+		d.FrameQueueSize = 1024
+	}
+	if d.RespQueueSize == 0 {
+		d.RespQueueSize = 128
+	}
+	if len(d.Methods) == 0 {
+		d.Methods = []string{"POST"}
+	}
+	if d.FrameSizeHistogram && d.sizes == nil {
+		d.sizes = &frameSizes{}
+	}
+}
+
+func (d *CommonOptions) allowMethod(method string) bool {
+	for _, m := range d.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
 }
 
+// frameVersion returns the max frame version allowed by IVStrategy
+func (d *CommonOptions) maxFrameVersion() byte {
+	if d.IVStrategy == IVDerived {
+		return 1
+	}
+	return frameVersion
+}
+
+const (
+	OverflowBlock = iota
+	OverflowError
+)
+
+const (
+	IVRandom = iota
+	IVDerived
+)
+
 type Option func(d *Dialer, ln *Listener)
 
 var (
@@ -31,6 +157,29 @@ var (
 			}
 		})
 	}
+	WithHTTPClient = func(client *http.Client) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.HTTPClient = client
+			}
+		})
+	}
+	WithConnLimits = func(maxIdle, maxIdlePerHost, maxPerHost int) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.MaxIdleConns = maxIdle
+				d.MaxIdleConnsPerHost = maxIdlePerHost
+				d.MaxConnsPerHost = maxPerHost
+			}
+		})
+	}
+	WithIdleConnTimeout = func(t time.Duration) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.IdleConnTimeout = t
+			}
+		})
+	}
 	WithInactiveTimeout = func(t time.Duration) Option {
 		return Option(func(d *Dialer, ln *Listener) {
 			if d != nil {
@@ -41,11 +190,227 @@ var (
 			}
 		})
 	}
+	WithTimeoutJitter = func(fraction float64) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.TimeoutJitter = fraction
+			}
+			if ln != nil {
+				ln.TimeoutJitter = fraction
+			}
+		})
+	}
+	WithBaseTimeout = func(t time.Duration) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.BaseTimeout = t
+			}
+		})
+	}
+	WithBytesPerSecondFloor = func(bps int) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.BytesPerSecondFloor = bps
+			}
+		})
+	}
+	WithMaxOrchWorkers = func(n int) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.MaxOrchWorkers = n
+			}
+		})
+	}
+	WithOrchQueueSize = func(n int) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.OrchQueueSize = n
+			}
+		})
+	}
+	WithMaxSendWorkers = func(n int) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.MaxSendWorkers = n
+			}
+		})
+	}
+	WithClientDriven = func(idle time.Duration) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.ClientDriven = idle
+			}
+		})
+	}
+	WithOnSendError = func(callback func(attempt int, err error)) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.OnSendError = callback
+			}
+		})
+	}
+	WithOnResponseHeaders = func(callback func(http.Header)) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.OnResponseHeaders = callback
+			}
+		})
+	}
+	WithTLSConfig = func(config *tls.Config) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.TLSConfig = config
+			}
+		})
+	}
+	WithReadBufferSize = func(size int) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.ReadBufferSize = size
+			}
+		})
+	}
+	// WithServerKey makes the dialer verify hello responses by the public key, see Listener.SigningKey
+	WithServerKey = func(key ed25519.PublicKey) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.ServerKey = key
+			}
+		})
+	}
+	WithSigningKey = func(key ed25519.PrivateKey) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if ln != nil {
+				ln.SigningKey = key
+			}
+		})
+	}
+	WithClientVersion = func(version string) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.ClientVersion = version
+			}
+		})
+	}
+	WithMaxConcurrentDials = func(n int) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.MaxConcurrentDials = n
+			}
+		})
+	}
+	WithFailureThreshold = func(consecutive int) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.FailureThreshold = consecutive
+			}
+		})
+	}
+	WithOnSendSizeEvent = func(callback func(old, new int)) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.OnSendSizeEvent = callback
+			}
+		})
+	}
+	WithHandshakeRetry = func(attempts int, backoff time.Duration) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.HandshakeAttempts, d.HandshakeBackoff = attempts, backoff
+			}
+		})
+	}
+	WithBackoff = func(b Backoff) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.Backoff = b
+			}
+		})
+	}
+	WithFlushInterval = func(t time.Duration) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.FlushInterval = t
+			}
+		})
+	}
+	WithOrchIdle = func(min, max time.Duration) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.OrchIdleMin, d.OrchIdleMax = min, max
+			}
+		})
+	}
+	WithOrchWindow = func(window time.Duration) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.OrchWindow = window
+			}
+		})
+	}
+	WithDirectSend = func() Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.DirectSend = true
+			}
+		})
+	}
+	WithMaxRequestRate = func(perSec float64) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.MaxRequestRate = perSec
+			}
+		})
+	}
+	// WithoutFrameEncryption disables encryption of data frames for dialers, and allows it for listeners
+	WithoutFrameEncryption = func() Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.NoFrameEncryption = true
+			}
+			if ln != nil {
+				ln.AllowPlaintext = true
+			}
+		})
+	}
+	WithDataKey = func(key string) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.DataKey = key
+			}
+			if ln != nil {
+				ln.DataKey = key
+			}
+		})
+	}
+	WithHelloKey = func(key string) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.HelloKey = key
+			}
+			if ln != nil {
+				ln.HelloKey = key
+			}
+		})
+	}
 	WithWebSocket = func(ws bool) Option {
 		return Option(func(d *Dialer, ln *Listener) {
 			if d != nil {
 				d.WebSocket = ws
 			}
+			if ln != nil {
+				ln.WebSocket = ws
+			}
+		})
+	}
+	WithDefaultReadTimeout = func(t time.Duration) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.DefaultReadTimeout = t
+			}
+			if ln != nil {
+				ln.DefaultReadTimeout = t
+			}
 		})
 	}
 	WithMaxWriteBuffer = func(size int) Option {
@@ -58,6 +423,144 @@ var (
 			}
 		})
 	}
+	WithQueueSize = func(frames, resps int, policy byte) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.FrameQueueSize, d.RespQueueSize, d.OverflowPolicy = frames, resps, policy
+			}
+			if ln != nil {
+				ln.FrameQueueSize, ln.RespQueueSize, ln.OverflowPolicy = frames, resps, policy
+			}
+		})
+	}
+	WithRingReadBuffer = func(size int) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.RingReadBuffer = size
+			}
+			if ln != nil {
+				ln.RingReadBuffer = size
+			}
+		})
+	}
+	WithNonBlockingWrite = func() Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.NonBlockingWrite = true
+			}
+			if ln != nil {
+				ln.NonBlockingWrite = true
+			}
+		})
+	}
+	WithMaxReadBacklog = func(size int) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.MaxReadBacklog = size
+			}
+			if ln != nil {
+				ln.MaxReadBacklog = size
+			}
+		})
+	}
+	WithOnServeError = func(f func(err error)) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if ln != nil {
+				ln.OnServeError = f
+			}
+		})
+	}
+	WithServerMemoryLimit = func(bytes int64) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if ln != nil {
+				ln.MemoryLimit = bytes
+			}
+		})
+	}
+	WithMaxConnAge = func(age, sweep time.Duration) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if ln != nil {
+				ln.MaxConnAge, ln.SweepInterval = age, sweep
+			}
+		})
+	}
+	WithEvents = func(ch chan<- ConnEvent) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.Events = ch
+			}
+			if ln != nil {
+				ln.Events = ch
+			}
+		})
+	}
+	WithOnClose = func(f func(conn *ServerConn)) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if ln != nil {
+				ln.OnClose = f
+			}
+		})
+	}
+	WithReadCoalesce = func(t time.Duration) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.ReadCoalesce = t
+			}
+			if ln != nil {
+				ln.ReadCoalesce = t
+			}
+		})
+	}
+	WithUnordered = func() Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.Unordered = true
+			}
+			if ln != nil {
+				ln.Unordered = true
+			}
+		})
+	}
+	WithIVStrategy = func(s byte) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.IVStrategy = s
+			}
+			if ln != nil {
+				ln.IVStrategy = s
+			}
+		})
+	}
+	WithReorderTimeout = func(t time.Duration) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.ReorderTimeout = t
+			}
+			if ln != nil {
+				ln.ReorderTimeout = t
+			}
+		})
+	}
+	WithFrameSizeHistogram = func() Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.FrameSizeHistogram = true
+			}
+			if ln != nil {
+				ln.FrameSizeHistogram = true
+			}
+		})
+	}
+	WithMethods = func(methods ...string) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if d != nil {
+				d.Methods = methods
+			}
+			if ln != nil {
+				ln.Methods = methods
+			}
+		})
+	}
 	WithPath = func(path string) Option {
 		return Option(func(d *Dialer, ln *Listener) {
 			if d != nil {
@@ -68,6 +571,46 @@ var (
 			}
 		})
 	}
+	// WithNetwork serves an extra network with its own key on the path,
+	// dialers of this network should use the same path
+	WithNetwork = func(network, path string) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if ln != nil {
+				ln.networks[path] = lnNetwork{name: network, blk: newBlock(network)}
+			}
+		})
+	}
+	WithHealthPath = func(path string) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if ln != nil {
+				ln.HealthPath = path
+			}
+		})
+	}
+	// WithServerKeepalive sets TCP keepalive of accepted connections, zero fields of the config
+	// (Idle, Interval and Count) mean the system defaults, see net.KeepAliveConfig
+	WithServerKeepalive = func(cfg net.KeepAliveConfig) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if ln != nil {
+				cfg.Enable = true
+				ln.Keepalive = cfg
+			}
+		})
+	}
+	WithServerPush = func(hold time.Duration) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if ln != nil {
+				ln.PushHold = hold
+			}
+		})
+	}
+	WithServerRequestTimeout = func(timeout time.Duration) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if ln != nil {
+				ln.RequestTimeout = timeout
+			}
+		})
+	}
 	WithBadRequest = func(callback http.HandlerFunc) Option {
 		return Option(func(d *Dialer, ln *Listener) {
 			if ln != nil {
@@ -75,6 +618,13 @@ var (
 			}
 		})
 	}
+	WithOnFrame = func(callback func(connIdx uint64, options byte)) Option {
+		return Option(func(d *Dialer, ln *Listener) {
+			if ln != nil {
+				ln.OnFrame = callback
+			}
+		})
+	}
 	WithBadRequestRoundTripper = func(rt http.RoundTripper) Option {
 		return Option(func(d *Dialer, ln *Listener) {
 			if ln != nil {
@@ -2,6 +2,7 @@ package toh
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"math/rand"
 	"sync/atomic"
@@ -25,16 +26,19 @@ func (d *Dialer) startOrch() {
 	)
 
 	go func() {
+		lastActive := time.Now()
 		for {
 			conns := make(map[uint64]*ClientConn)
 			loopcount++
 
+			// The window is fixed, so conns polling all the time can't keep extending it
+			window := time.After(d.OrchWindow)
 		READ:
 			for {
 				select {
 				case c := <-d.orch:
 					conns[c.idx] = c
-				case <-time.After((time.Millisecond) * 50):
+				case <-window:
 					break READ
 				}
 			}
@@ -45,17 +49,21 @@ func (d *Dialer) startOrch() {
 			}
 
 			if len(conns) == 0 {
-				time.Sleep(200 * time.Millisecond)
+				time.Sleep(d.orchIdle(time.Since(lastActive)))
 				continue
 			}
+			lastActive = time.Now()
+
+			// Conns collected are answered after resuming
+			d.waitResume(context.Background())
 
 			var p bytes.Buffer
 			var lastconn *ClientConn
 
 			for k, conn := range conns {
-				if len(conn.write.buf) > 0 || conn.write.survey.lastIsPositive {
+				if atomic.LoadInt64(&conn.write.buffered) > 0 || conn.write.survey.lastIsPositive {
 					// For connections with actual data waiting to be sent, send them directly
-					go conn.sendWriteBuf()
+					d.workers.Go(conn.sendWriteBuf)
 					delete(conns, k)
 					directs++
 					continue
@@ -68,7 +76,7 @@ func (d *Dialer) startOrch() {
 			if len(conns) <= 3 {
 				for _, conn := range conns {
 					directs++
-					go conn.sendWriteBuf()
+					d.workers.Go(conn.sendWriteBuf)
 				}
 				lastconn = nil
 			}
@@ -78,10 +86,11 @@ func (d *Dialer) startOrch() {
 				continue
 			}
 
-			pingframe := frame{options: optPing, data: p.Bytes()}
+			pingframe := frame{options: optPing, version: lastconn.read.version, data: p.Bytes()}
 			pings += p.Len() / 8
 
-			go func(pingframe frame, lastconn *ClientConn, conns map[uint64]*ClientConn) {
+			d.orchWorkers.Wait()
+			d.orchWorkers.Go(func() {
 				resp, err := lastconn.send(pingframe)
 				if err != nil {
 					vprint("send error: ", err)
@@ -89,41 +98,78 @@ func (d *Dialer) startOrch() {
 				}
 				defer resp.Body.Close()
 
-				f, ok := parseframe(resp.Body, lastconn.read.blk)
+				f, ok := parseframe(resp.Body, d.blk)
 				if !ok || f.options != optPing {
-					return
+					f.data = nil
 				}
 
-				for i := 0; i < len(f.data); i += 10 {
+				for i := 0; i+10 <= len(f.data); i += 10 {
 					connState := binary.BigEndian.Uint16(f.data[i:])
 					connIdx := binary.BigEndian.Uint64(f.data[i+2:])
 
-					if c := conns[connIdx]; c != nil && !c.read.closed && c.read.err == nil {
+					c := conns[connIdx]
+					delete(conns, connIdx)
+					if c != nil && !c.read.closed && c.read.err == nil {
 						switch connState {
 						case PING_CLOSED:
 							vprint(c, " the other side is closed")
-							c.read.feedError(errClosedConn)
-							c.Close()
+							c.read.closeByPeer(nil)
+							c.closeLocal()
 						case PING_OK_VOID:
 							c.write.survey.lastIsPositive = false
 						case PING_OK:
 							atomic.AddUint64(&positives, 1)
 							c.write.survey.lastIsPositive = true
-							go c.sendWriteBuf()
+							d.workers.Go(c.sendWriteBuf)
+						}
+					}
+				}
+
+				if len(conns) > 0 {
+					// The server answers every conn in the batch, the response has been truncated or mangled
+					// on the way. Don't leave the rest starving until the next batch, send them directly
+					atomic.AddUint64(&d.orchTruncated, 1)
+					vprint("orch: ", len(conns), " conns unanswered by the batched ping, send them directly")
+					for _, c := range conns {
+						if !c.read.closed && c.read.err == nil {
+							d.workers.Go(c.sendWriteBuf)
 						}
 					}
 				}
 
 				resp.Body.Close()
-			}(pingframe, lastconn, conns)
+			})
 		}
 	}()
 }
 
+// orchIdle returns how long the orchestrator sleeps after no conn has polled for the duration,
+// a tenth of it, bounded by OrchIdleMin and OrchIdleMax
+func (d *Dialer) orchIdle(idle time.Duration) time.Duration {
+	sleep := idle / 10
+	if sleep < d.OrchIdleMin {
+		sleep = d.OrchIdleMin
+	}
+	if sleep > d.OrchIdleMax {
+		sleep = d.OrchIdleMax
+	}
+	return sleep
+}
+
 func (d *Dialer) orchSendWriteBuf(c *ClientConn) {
+	if d.Paused() {
+		// Resume will reschedule it
+		return
+	}
+	if d.DirectSend {
+		d.workers.Go(c.sendWriteBuf)
+		return
+	}
 	select {
 	case d.orch <- c:
 	default:
-		go c.sendWriteBuf()
+		atomic.AddUint64(&d.orchFallbacks, 1)
+		vprint("orchestrator queue is full, sending directly: ", c)
+		d.workers.Go(c.sendWriteBuf)
 	}
 }
@@ -0,0 +1,295 @@
+package toh
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memTransport delivers requests to the listener's handler directly, without any real network
+type memTransport struct {
+	l *Listener
+}
+
+func (t memTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	t.l.handler(rec, req)
+	req.Body.Close()
+	return rec.Result(), nil
+}
+
+// truncatingTransport cuts responses of batched pings short, like a misbehaving proxy
+type truncatingTransport struct {
+	memTransport
+	blk       cipher.Block
+	truncated int32
+}
+
+func (t *truncatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, _ := ioutil.ReadAll(req.Body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp, err := t.memTransport.RoundTrip(req)
+	if f, ok := parseframe(ioutil.NopCloser(bytes.NewReader(body)), t.blk); ok && f.options == optPing && err == nil {
+		atomic.AddInt32(&t.truncated, 1)
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data[:len(data)/2]))
+	}
+	return resp, err
+}
+
+func TestOrchTruncatedPing(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+		}
+	}()
+
+	tr := &truncatingTransport{memTransport: memTransport{ln.(*Listener)}}
+	d := NewDialer("tcp", ln.Addr().String(), WithTransport(tr))
+	tr.blk = d.blk
+
+	// Enough conns to be batched, all of them are idle so they can only be served after pinging
+	conns := make([]net.Conn, 8)
+	for i := range conns {
+		if conns[i], err = d.Dial(); err != nil {
+			t.Fatal(err)
+		}
+		defer conns[i].Close()
+	}
+	for _, conn := range conns {
+		buf := make([]byte, 5)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Fatal(err)
+		}
+	}
+	if atomic.LoadInt32(&tr.truncated) == 0 || d.Stats().OrchTruncated == 0 {
+		t.Fatal("no ping is truncated")
+	}
+}
+
+func TestOrchIdle(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := NewDialer("tcp", ln.Addr().String(), WithOrchWindow(5*time.Millisecond),
+		WithOrchIdle(5*time.Millisecond, time.Second)).Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	// Larger than the pending size, so each write is sent by the orchestrator right away
+	p := make([]byte, 2*maxPendingSize)
+	for i := 0; i < 3; i++ {
+		// After a brief pause, the orchestrator should still be sleeping shortly
+		time.Sleep(200 * time.Millisecond)
+		start := time.Now()
+		conn.Write(p)
+		sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(sc, p); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d > 80*time.Millisecond {
+			t.Fatal("write after idle delayed: ", d)
+		}
+	}
+	if d := conn.(*ClientConn).dialer.orchIdle(time.Hour); d != time.Second {
+		t.Fatal(d)
+	}
+}
+
+func TestOrchFallbacks(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if d := NewDialer("tcp", ln.Addr().String()); cap(d.orch) != 128 {
+		t.Fatal(cap(d.orch))
+	}
+
+	d := NewDialer("tcp", ln.Addr().String(), WithOrchQueueSize(1))
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Polls queue up faster than the orchestrator can take them
+	for i := 0; i < 100; i++ {
+		d.orchSendWriteBuf(conn.(*ClientConn))
+	}
+	if n := d.Stats().OrchFallbacks; n == 0 {
+		t.Fatal("no fallback")
+	}
+}
+
+// benchmarkOrch writes b.N chunks across n conns and waits for all of them to arrive at the server
+func benchmarkOrch(b *testing.B, n int, options ...Option) {
+	Verbose = false
+	const chunk = 4096
+
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	l := ln.(*Listener)
+
+	var received int64
+	total := int64(b.N) * chunk
+	done := make(chan bool)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				buf := make([]byte, chunk)
+				for {
+					nr, err := conn.Read(buf)
+					if atomic.AddInt64(&received, int64(nr)) == total && nr > 0 {
+						close(done)
+					}
+					if err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	d := NewDialer("tcp", ln.Addr().String(), append(options, WithTransport(memTransport{l}))...)
+	conns := make([]net.Conn, n)
+	for i := range conns {
+		if conns[i], err = d.Dial(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	requests := l.HTTPStats().Requests
+	b.SetBytes(chunk)
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		count := b.N / n
+		if i < b.N%n {
+			count++
+		}
+		wg.Add(1)
+		go func(conn net.Conn, count int) {
+			defer wg.Done()
+			p := make([]byte, chunk)
+			for j := 0; j < count; j++ {
+				conn.Write(p)
+			}
+		}(conn, count)
+	}
+	wg.Wait()
+
+	select {
+	case <-done:
+	case <-time.After(time.Minute):
+		b.Fatal("timed out, received: ", atomic.LoadInt64(&received), "/", total)
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(l.HTTPStats().Requests-requests), "requests")
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func BenchmarkOrch(b *testing.B) {
+	for _, n := range []int{1, 16, 64} {
+		for _, window := range []time.Duration{10 * time.Millisecond, 50 * time.Millisecond, 200 * time.Millisecond} {
+			b.Run(fmt.Sprintf("conns=%d/window=%v", n, window), func(b *testing.B) {
+				benchmarkOrch(b, n, WithOrchWindow(window))
+			})
+		}
+		b.Run(fmt.Sprintf("conns=%d/direct", n), func(b *testing.B) {
+			benchmarkOrch(b, n, WithDirectSend())
+		})
+	}
+}
+
+// slowPingTransport delays batched pings, tracking the max number of them in flight
+type slowPingTransport struct {
+	memTransport
+	blk            cipher.Block
+	inflight, peak int32
+	pings          int32
+}
+
+func (t *slowPingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, _ := ioutil.ReadAll(req.Body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if f, ok := parseframe(ioutil.NopCloser(bytes.NewReader(body)), t.blk); ok && f.options == optPing {
+		atomic.AddInt32(&t.pings, 1)
+		n := atomic.AddInt32(&t.inflight, 1)
+		defer atomic.AddInt32(&t.inflight, -1)
+		for p := atomic.LoadInt32(&t.peak); n > p && !atomic.CompareAndSwapInt32(&t.peak, p, n); p = atomic.LoadInt32(&t.peak) {
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+	return t.memTransport.RoundTrip(req)
+}
+
+func TestOrchWorkersBound(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	tr := &slowPingTransport{memTransport: memTransport{ln.(*Listener)}}
+	d := NewDialer("tcp", ln.Addr().String(), WithTransport(tr), WithMaxOrchWorkers(1), WithFlushInterval(20*time.Millisecond))
+	tr.blk = d.blk
+
+	// Enough idle conns to be batched, they keep polling while pings are slow
+	for i := 0; i < 8; i++ {
+		conn, err := d.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	for start := time.Now(); time.Since(start) < 1500*time.Millisecond; time.Sleep(10 * time.Millisecond) {
+		if n := d.Stats().OrchGoroutines; n > 1 {
+			t.Fatal("orch goroutines: ", n)
+		}
+	}
+	if pings, peak := atomic.LoadInt32(&tr.pings), atomic.LoadInt32(&tr.peak); pings < 2 || peak != 1 {
+		t.Fatal("pings: ", pings, ", max in flight: ", peak)
+	}
+}
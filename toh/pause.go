@@ -0,0 +1,67 @@
+package toh
+
+import "context"
+
+// Pause stops the dialer from sending requests: polls, sends of buffered data and batched pings wait
+// until Resume, so are new handshakes, while requests in flight complete. No conn is closed, Write keeps
+// buffering data up to MaxWriteBuffer of each conn, then it blocks (or returns ErrBufferFull by NonBlockingWrite),
+// and nothing will be read meanwhile. A long pause is risky: the buffers of all conns grow at once, read
+// deadlines and DefaultReadTimeout still expire, and the listener purges conns it hasn't heard from
+// for its Timeout, so pauses should stay well below that
+func (d *Dialer) Pause() {
+	d.pausemu.Lock()
+	if d.resumed == nil {
+		d.resumed = make(chan struct{})
+		vprint("dialer paused")
+	}
+	d.pausemu.Unlock()
+}
+
+// Resume undoes Pause, data buffered during the pause are sent right away
+func (d *Dialer) Resume() {
+	d.pausemu.Lock()
+	resumed := d.resumed
+	d.resumed = nil
+	d.pausemu.Unlock()
+	if resumed == nil {
+		return
+	}
+	close(resumed)
+	vprint("dialer resumed")
+
+	d.connsmu.Lock()
+	conns := make([]*ClientConn, 0, len(d.conns))
+	for _, c := range d.conns {
+		conns = append(conns, c)
+	}
+	d.connsmu.Unlock()
+
+	for _, c := range conns {
+		if !c.read.closed && c.read.err == nil {
+			c.schedSending()
+		}
+	}
+}
+
+// Paused returns true between Pause and Resume
+func (d *Dialer) Paused() bool {
+	return d.pausing() != nil
+}
+
+func (d *Dialer) pausing() chan struct{} {
+	d.pausemu.Lock()
+	defer d.pausemu.Unlock()
+	return d.resumed
+}
+
+// waitResume blocks while the dialer is paused
+func (d *Dialer) waitResume(ctx context.Context) error {
+	if resumed := d.pausing(); resumed != nil {
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
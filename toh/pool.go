@@ -0,0 +1,66 @@
+package toh
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// goPool runs functions in goroutines, at most size of them can be running at the same time
+type goPool struct {
+	mu      sync.Mutex
+	freed   *sync.Cond // signaled when a goroutine exits, see Wait
+	size    int
+	running int64
+	queue   []func() // waiting for a free goroutine
+}
+
+func newGoPool(size int) *goPool {
+	p := &goPool{size: size}
+	p.freed = sync.NewCond(&p.mu)
+	return p
+}
+
+// Go never blocks, so it is safe to call from the pool's own functions and from timers.
+// If the pool is full, f is queued and run by the next goroutine finishing its function
+func (p *goPool) Go(f func()) {
+	p.mu.Lock()
+	if int(atomic.LoadInt64(&p.running)) >= p.size {
+		p.queue = append(p.queue, f)
+		p.mu.Unlock()
+		return
+	}
+	atomic.AddInt64(&p.running, 1)
+	p.mu.Unlock()
+	go p.run(f)
+}
+
+func (p *goPool) run(f func()) {
+	for f != nil {
+		f()
+
+		p.mu.Lock()
+		f = nil
+		if len(p.queue) > 0 {
+			f, p.queue[0] = p.queue[0], nil
+			p.queue = p.queue[1:]
+		} else {
+			atomic.AddInt64(&p.running, -1)
+			p.freed.Broadcast()
+		}
+		p.mu.Unlock()
+	}
+}
+
+// Wait blocks until the pool is not full, a submitter which should be slowed down by the pool
+// (e.g. the orchestrator) calls it before Go
+func (p *goPool) Wait() {
+	p.mu.Lock()
+	for int(atomic.LoadInt64(&p.running)) >= p.size {
+		p.freed.Wait()
+	}
+	p.mu.Unlock()
+}
+
+func (p *goPool) Running() int {
+	return int(atomic.LoadInt64(&p.running))
+}
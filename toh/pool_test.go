@@ -0,0 +1,70 @@
+package toh
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGoPoolSaturated(t *testing.T) {
+	p := newGoPool(2)
+
+	// Functions of a full pool submit more, like the orchestrator's ping callbacks
+	var done sync.WaitGroup
+	var running, peak int64
+	block := make(chan bool)
+	for i := 0; i < 2; i++ {
+		done.Add(1)
+		p.Go(func() {
+			<-block
+			for j := 0; j < 10; j++ {
+				done.Add(1)
+				p.Go(func() {
+					defer done.Done()
+					for n := atomic.AddInt64(&running, 1); ; {
+						if old := atomic.LoadInt64(&peak); n <= old || atomic.CompareAndSwapInt64(&peak, old, n) {
+							break
+						}
+					}
+					time.Sleep(time.Millisecond)
+					atomic.AddInt64(&running, -1)
+				})
+			}
+			done.Done()
+		})
+	}
+
+	// Submitting to a full pool doesn't block, e.g. from timers
+	submitted := make(chan bool)
+	done.Add(1)
+	go func() {
+		p.Go(func() { done.Done() })
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+	case <-time.After(time.Second):
+		t.Fatal("Go blocked by a full pool")
+	}
+
+	close(block)
+	finished := make(chan bool)
+	go func() {
+		done.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued functions not run")
+	}
+	if peak > 2 {
+		t.Fatal("pool exceeded: ", peak)
+	}
+
+	p.Wait()
+	if n := p.Running(); n != 0 {
+		t.Fatal(n)
+	}
+}
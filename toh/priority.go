@@ -0,0 +1,54 @@
+package toh
+
+import "sync/atomic"
+
+// writeMark is the end offset in the write buffer of successive writes of the same priority
+type writeMark struct {
+	end    int
+	prio   int
+	pinned bool // nothing can jump ahead of the data, e.g. the rest of a partially sent write
+}
+
+// pinWriteBuf stops further writes from jumping ahead of data in the write buffer, which are being sent
+// and may have been received if the send fails, c.write must be locked
+func (c *ClientConn) pinWriteBuf() {
+	if len(c.write.buf) > 0 {
+		c.write.marks = append(c.write.marks[:0], writeMark{end: len(c.write.buf), pinned: true})
+	}
+}
+
+// push buffers p as a whole behind all data of priorities no lower than prio, c.write must be locked
+func (c *ClientConn) push(p []byte, prio int, pinned bool) {
+	if len(p) == 0 {
+		return
+	}
+
+	marks := c.write.marks
+	i := len(marks)
+	for i > 0 && !marks[i-1].pinned && marks[i-1].prio < prio {
+		i--
+	}
+	pos := 0
+	if i > 0 {
+		pos = marks[i-1].end
+	}
+
+	c.write.buf = append(c.write.buf, p...)
+	if pos < len(c.write.buf)-len(p) {
+		copy(c.write.buf[pos+len(p):], c.write.buf[pos:])
+		copy(c.write.buf[pos:], p)
+	}
+	atomic.StoreInt64(&c.write.buffered, int64(len(c.write.buf)))
+
+	for j := i; j < len(marks); j++ {
+		marks[j].end += len(p)
+	}
+	if i > 0 && marks[i-1].prio == prio && marks[i-1].pinned == pinned {
+		marks[i-1].end += len(p)
+		return
+	}
+	marks = append(marks, writeMark{})
+	copy(marks[i+1:], marks[i:])
+	marks[i] = writeMark{end: pos + len(p), prio: prio, pinned: pinned}
+	c.write.marks = marks
+}
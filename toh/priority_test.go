@@ -0,0 +1,75 @@
+package toh
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestWriteMarks(t *testing.T) {
+	type write struct {
+		data   string
+		prio   int
+		pinned bool
+	}
+	for _, tc := range []struct {
+		writes []write
+		want   string
+	}{
+		{[]write{{"a", 0, false}, {"b", 0, false}, {"c", 0, false}}, "abc"},
+		{[]write{{"a", 0, false}, {"b", 1, false}, {"c", 2, false}}, "cba"},
+		{[]write{{"a", 0, false}, {"b", 1, false}, {"c", 1, false}, {"d", 0, false}}, "bcad"},
+		{[]write{{"a", 0, false}, {"b", -1, false}, {"c", 0, false}}, "acb"},
+		{[]write{{"a", 0, true}, {"b", 1, false}, {"c", 2, false}}, "acb"},
+		{[]write{{"a", 1, false}, {"b", 0, true}, {"c", 2, false}}, "abc"},
+	} {
+		c := &ClientConn{}
+		for _, w := range tc.writes {
+			c.push([]byte(w.data), w.prio, w.pinned)
+		}
+		if string(c.write.buf) != tc.want || c.WriteBufferedBytes() != len(tc.want) {
+			t.Fatal(string(c.write.buf), ", want ", tc.want)
+		}
+		if m := c.write.marks; len(m) == 0 || m[len(m)-1].end != len(tc.want) {
+			t.Fatal(m)
+		}
+	}
+}
+
+func TestWritePriority(t *testing.T) {
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	d := NewDialer("tcp", ln.Addr().String())
+	conn, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	c := conn.(*ClientConn)
+
+	// The control message jumps ahead of bulk data buffered in the meantime, nothing is sent until schedSending
+	c.SetFlushInterval(time.Hour)
+	c.write.Lock()
+	c.setPendingSize(1 << 20)
+	c.write.Unlock()
+	c.Write([]byte("bulk1,"))
+	c.Write([]byte("bulk2,"))
+	c.WritePriority([]byte("ctl,"), 1)
+	c.Write([]byte("bulk3"))
+	c.schedSending()
+
+	buf := make([]byte, 21)
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(sc, buf); err != nil || string(buf) != "ctl,bulk1,bulk2,bulk3" {
+		t.Fatal(string(buf), err)
+	}
+}
@@ -1,7 +1,11 @@
 package toh
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -9,45 +13,10 @@ import (
 	"net/url"
 	"os"
 	"runtime/pprof"
-	"strings"
 	"testing"
 	"time"
 )
 
-func iocopy(dst io.Writer, src io.Reader) (written int64, err error) {
-	size := 32 * 1024
-	buf := make([]byte, size)
-	for {
-		nr, er := src.Read(buf)
-		if nr > 0 {
-			nw, ew := dst.Write(buf[0:nr])
-			if nw > 0 {
-				written += int64(nw)
-			}
-			if ew != nil {
-				err = ew
-				break
-			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				break
-			}
-		}
-		if er != nil {
-			if er != io.EOF {
-				err = er
-			}
-			break
-		}
-	}
-	return written, err
-}
-
-func bridge(a, b io.ReadWriteCloser) {
-	go func() { iocopy(a, b); a.Close(); b.Close() }()
-	go func() { iocopy(b, a); a.Close(); b.Close() }()
-}
-
 type client int
 
 type server int
@@ -55,54 +24,22 @@ type server int
 var dd *Dialer
 
 func (s *client) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	host := r.Host
-	if !strings.Contains(host, ":") {
-		host += ":80"
-	}
-
 	up, err := dd.Dial()
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	up.Write([]byte(r.Method[:1] + host + "\n"))
 
 	down, _, _ := w.(http.Hijacker).Hijack()
-	if r.Method != "CONNECT" {
+	if r.Method == "CONNECT" {
+		up.Write([]byte("CONNECT " + r.Host + " HTTP/1.1\r\nHost: " + r.Host + "\r\n\r\n"))
+	} else {
 		header, _ := httputil.DumpRequestOut(r, false)
-		x := string(header)
-		up.Write([]byte(x))
+		up.Write(header)
 		io.Copy(up, r.Body)
 	}
 
-	bridge(down, up)
-}
-
-func foo(conn net.Conn) {
-	down := NewBufConn(conn)
-	buf, err := down.ReadBytes('\n')
-	if err != nil || len(buf) < 2 {
-		conn.Close()
-		return
-	}
-
-	host := string(buf)
-	connect := host[0] == 'C'
-	host = host[1 : len(host)-1]
-	// vprint(host, connect)
-
-	up, _ := net.Dial("tcp", host)
-
-	if up == nil || down == nil {
-		down.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n\r\n"))
-		return
-	}
-
-	if connect {
-		down.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-	}
-
-	bridge(down, up)
+	Bridge(down, up)
 }
 
 func TestProxy(t *testing.T) {
@@ -126,13 +63,10 @@ func TestProxy(t *testing.T) {
 			up = ":10001"
 		}
 
-		tr := *http.DefaultTransport.(*http.Transport)
-		tr.MaxConnsPerHost = 100
-
 		u, _ := url.Parse("http://example.com")
 
 		dd = NewDialer("tcp", up,
-			WithTransport(&tr),
+			WithConnLimits(100, 100, 100),
 			WithInactiveTimeout(time.Second*10),
 			WithWebSocket(ws),
 			WithPath("/aaa"))
@@ -141,14 +75,214 @@ func TestProxy(t *testing.T) {
 
 		ln, _ := Listen("tcp", ":10001",
 			WithInactiveTimeout(time.Second*10),
+			WithWebSocket(ws),
 			WithPath("/aaa"),
 			WithBadRequest(httputil.NewSingleHostReverseProxy(u).ServeHTTP))
 		for {
 			conn, _ := ln.Accept()
-			go foo(conn)
+			go new(Forwarder).Serve(conn)
 		}
 	}()
 
 	//	Verbose = false
 	select {}
 }
+
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.(*net.TCPConn), b.(*net.TCPConn)
+}
+
+func TestBridgeHalfClose(t *testing.T) {
+	a1, a2 := tcpPair(t)
+	b1, b2 := tcpPair(t)
+
+	done := make(chan bool)
+	go func() { Bridge(a2, b1); done <- true }()
+
+	a1.Write([]byte("ping"))
+	a1.CloseWrite()
+
+	buf, _ := ioutil.ReadAll(b2)
+	if string(buf) != "ping" {
+		t.Fatal(string(buf))
+	}
+
+	// b2 can still write after a1 has closed its write side
+	b2.Write([]byte("pong"))
+	b2.Close()
+
+	buf, _ = ioutil.ReadAll(a1)
+	if string(buf) != "pong" {
+		t.Fatal(string(buf))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("bridge didn't return")
+	}
+
+	// Both ends are closed once both directions are half closed
+	for _, c := range []net.Conn{a2, b1} {
+		if _, err := c.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDialWrap(t *testing.T) {
+	ln, _ := Listen("tcp", "127.0.0.1:13740")
+	defer ln.Close()
+
+	go func() {
+		conn, _ := ln.Accept()
+		p := make([]byte, 4)
+		io.ReadFull(conn, p)
+		conn.Write(p)
+	}()
+
+	a1, a2 := tcpPair(t)
+	go DialWrap("tcp", "127.0.0.1:13740", a2)
+
+	a1.Write([]byte("ping"))
+	a1.SetReadDeadline(time.Now().Add(time.Second * 5))
+	p := make([]byte, 4)
+	if _, err := io.ReadFull(a1, p); err != nil || string(p) != "ping" {
+		t.Fatal(string(p), err)
+	}
+}
+
+func TestForwarderConnect(t *testing.T) {
+	target, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer target.Close()
+	go func() {
+		conn, _ := target.Accept()
+		io.Copy(conn, conn)
+	}()
+
+	a1, a2 := tcpPair(t)
+	go new(Forwarder).Serve(a2)
+
+	a1.Write([]byte("CONNECT " + target.Addr().String() + " HTTP/1.1\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(a1), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal(resp, err)
+	}
+
+	a1.Write([]byte("ping"))
+	p := make([]byte, 4)
+	a1.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.ReadFull(a1, p); err != nil || string(p) != "ping" {
+		t.Fatal(string(p), err)
+	}
+
+	// Unreachable target
+	b1, b2 := tcpPair(t)
+	go new(Forwarder).Serve(b2)
+	b1.Write([]byte("CONNECT 127.0.0.1:1 HTTP/1.1\r\n\r\n"))
+	resp, err = http.ReadResponse(bufio.NewReader(b1), nil)
+	if err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Fatal(resp, err)
+	}
+}
+
+func TestForwarderTargetFilter(t *testing.T) {
+	target, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer target.Close()
+	go func() {
+		conn, _ := target.Accept()
+		io.Copy(conn, conn)
+	}()
+
+	connect := func(f *Forwarder, host string) *http.Response {
+		a1, a2 := tcpPair(t)
+		go f.Serve(a2)
+		a1.Write([]byte("CONNECT " + host + " HTTP/1.1\r\n\r\n"))
+		a1.SetReadDeadline(time.Now().Add(time.Second * 5))
+		resp, err := http.ReadResponse(bufio.NewReader(a1), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Rewritten to the real target
+	f := &Forwarder{TargetFilter: func(string) (string, error) { return target.Addr().String(), nil }}
+	if resp := connect(f, "internal.service:80"); resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+
+	f = &Forwarder{TargetFilter: DenyPrivateTargets}
+	for _, host := range []string{target.Addr().String(), "[::1]:80", "10.0.0.1:80", "169.254.169.254:80", "0.0.0.0:80"} {
+		if resp := connect(f, host); resp.StatusCode != http.StatusForbidden {
+			t.Fatal(host, ": ", resp.Status)
+		}
+	}
+	if _, err := DenyPrivateTargets("8.8.8.8:53"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSocks5UDP(t *testing.T) {
+	echo, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	// The tunnel is replaced by a TCP pair, whose other end is served by Forwarder
+	s := &Socks5{Dial: func() (net.Conn, error) {
+		a, b := tcpPair(t)
+		go new(Forwarder).Serve(b)
+		return a, nil
+	}}
+
+	c1, c2 := tcpPair(t)
+	go s.Serve(c2)
+
+	c1.Write([]byte{5, 1, 0})
+	c1.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 2+10)
+	c1.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.ReadFull(c1, reply); err != nil || reply[3] != 0 {
+		t.Fatal(reply, err)
+	}
+	bind := &net.UDPAddr{IP: net.IP(reply[6:10]), Port: int(reply[10])<<8 | int(reply[11])}
+
+	uc, _ := net.DialUDP("udp", nil, bind)
+	defer uc.Close()
+	hdr, _ := socksAddr(echo.LocalAddr().String())
+	uc.Write(append(append([]byte{0, 0, 0}, hdr...), "ping"...))
+
+	buf := make([]byte, 1024)
+	uc.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, err := uc.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], append(append([]byte{0, 0, 0}, hdr...), "ping"...)) {
+		t.Fatal(buf[:n])
+	}
+	c1.Close()
+}
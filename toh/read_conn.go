@@ -1,13 +1,16 @@
 package toh
 
 import (
+	"context"
 	"crypto/cipher"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coyove/common/waitobject"
@@ -16,39 +19,136 @@ import (
 var (
 	errClosedConn = fmt.Errorf("use of closed connection")
 	dummyTouch    = func(interface{}) interface{} { return 1 }
+
+	// ErrCloseNotAcked is returned by CloseWait when the server didn't acknowledge the close
+	ErrCloseNotAcked = fmt.Errorf("close is not acknowledged by the remote")
+
+	// ErrBarrierNotAcked is returned by Barrier when the server didn't acknowledge the barrier
+	ErrBarrierNotAcked = fmt.Errorf("barrier is not acknowledged by the remote")
+
+	// ErrTruncated is returned when the frame stream ends without the end frame
+	ErrTruncated = fmt.Errorf("truncated frame stream")
+
+	// ErrQueueFull is returned when the incoming queue is full under OverflowError policy
+	ErrQueueFull = fmt.Errorf("queue is full")
+
+	// ErrWriteAfterClose is returned by Write after CloseWrite
+	ErrWriteAfterClose = fmt.Errorf("write after CloseWrite")
+
+	// ErrReorderTimeout is returned when a missing frame doesn't arrive in ReorderTimeout
+	ErrReorderTimeout = fmt.Errorf("missing frame not arrived in time")
+
+	// ErrReadClosedByRemote is returned by ServerConn.Write after the client has called CloseRead
+	ErrReadClosedByRemote = fmt.Errorf("read side is closed by the remote")
 )
 
+// CloseError is returned by Read when the remote closes the conn with a code and reason
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("closed by the remote: %d %s", e.Code, e.Reason)
+}
+
+// marshal encodes the close error as the payload of optClosed frames: code 2b | reason
+func (e *CloseError) marshal() []byte {
+	if e == nil {
+		return nil
+	}
+	buf := make([]byte, 2+len(e.Reason))
+	binary.BigEndian.PutUint16(buf, uint16(e.Code))
+	copy(buf[2:], e.Reason)
+	return buf
+}
+
+// parseCloseError returns nil if the optClosed frame carries no code
+func parseCloseError(data []byte) *CloseError {
+	if len(data) < 2 {
+		return nil
+	}
+	return &CloseError{Code: int(binary.BigEndian.Uint16(data)), Reason: string(data[2:])}
+}
+
 // Define the max pending bytes stored in memory, any further bytes will be written to disk
 var MaxReadBufferSize = 1024 * 1024 * 1
 
 type readConn struct {
 	sync.Mutex
-	idx          uint64             // readConn index, should be the same as the one in ClientConn/SerevrConn
-	buf          []byte             // read buffer
-	frames       chan frame         // incoming frames
-	futureframes map[uint32]frame   // future frames, which have arrived early
-	futureSize   int                // total size of future frames
-	ready        *waitobject.Object // it being touched means that data in "buf" are ready
-	err          error              // stored error, if presented, all operations afterwards should return it
-	blk          cipher.Block       // cipher block, aes-128
-	closed       bool               // is readConn closed already
-	tag          byte               // tag, 'c' for readConn in ClientConn, 's' for readConn in ServerConn
-	counter      uint32             // counter, must be synced with the writer on the other side
-}
-
-func newReadConn(idx uint64, blk cipher.Block, tag byte) *readConn {
+	idx          uint64                 // readConn index, should be the same as the one in ClientConn/SerevrConn
+	buf          readBuffer             // read buffer
+	frames       chan frame             // incoming frames
+	futureframes map[uint32]frame       // future frames, which have arrived early
+	futureSize   int                    // total size of future frames
+	ready        *waitobject.Object     // it being touched means that data in "buf" are ready
+	err          error                  // stored error, if presented, all operations afterwards should return it
+	blk          cipher.Block           // cipher block, aes-128
+	closed       bool                   // is readConn closed already
+	tag          byte                   // tag, 'c' for readConn in ClientConn, 's' for readConn in ServerConn
+	counter      uint32                 // counter, must be synced with the writer on the other side
+	lookup       func(uint64) *readConn // find the readConn by connIdx, for frames of other connections
+	onFrame      func(uint64, byte)     // called with connIdx and options of every frame, see Listener.OnFrame
+	deadline     time.Time              // read deadline set by the caller, zero if not set
+	timeout      time.Duration          // default read timeout when deadline is not set
+	overflow     byte                   // policy when frames is full
+	peerClosed   bool                   // the peer has closed cleanly, see Read
+	localClosed  bool                   // closed by the local side, see Read
+	readClosed   bool                   // incoming data are discarded, see closeRead
+	closeErr     *CloseError            // the peer has closed with a code, returned instead of io.EOF
+	unordered    bool                   // deliver frames as they arrive, see CommonOptions.Unordered
+	reorder      time.Duration          // max time waiting for a missing frame, see CommonOptions.ReorderTimeout
+	coalesce     time.Duration          // max time Read waits for more data, see CommonOptions.ReadCoalesce
+	backlog      int                    // max bytes in buf before rearranging pauses, see CommonOptions.MaxReadBacklog
+	drained      chan struct{}          // signaled when data are read from buf or the conn is closed
+	ctx          context.Context        // Read returns its error once done, see setContext
+	done         chan struct{}          // closed when the conn is closed
+	version      byte                   // negotiated frame version, used by data frames written by the conn
+	endFrame     bool                   // frame streams of the peer must be terminated by the end frame, negotiated in hello
+	sizes        *frameSizes            // frame size histograms, nil if disabled
+	recvBytes    uint64                 // bytes delivered into buf
+	recvFrames   uint64                 // frames with data delivered into buf
+	reordered    uint64                 // frames which arrived early and had to wait in futureframes
+	maxGap       uint32                 // max distance of an early frame from the expected one
+	holBlocked   int64                  // total nanoseconds delivery was blocked by missing frames
+	gapSince     int64                  // monotime since which frames are waiting for a missing one, 0 if none
+	budget       *memBudget             // shared by the listener's conns, nil if unlimited, see Listener.MemoryLimit
+	budgetmu     sync.Mutex
+	logTag       atomic.Value // string, see ClientConn.SetLogTag
+	held         int64        // bytes counted against budget
+	released     bool         // held bytes have been returned to budget
+}
+
+func newReadConn(idx uint64, blk cipher.Block, tag byte, opts *CommonOptions) *readConn {
 	r := &readConn{
-		frames:       make(chan frame, 1024),
+		frames:       make(chan frame, opts.FrameQueueSize),
 		futureframes: map[uint32]frame{},
 		idx:          idx,
 		tag:          tag,
 		blk:          blk,
 		ready:        waitobject.New(),
+		timeout:      opts.DefaultReadTimeout,
+		overflow:     opts.OverflowPolicy,
+		unordered:    opts.Unordered,
+		reorder:      opts.ReorderTimeout,
+		coalesce:     opts.ReadCoalesce,
+		backlog:      opts.MaxReadBacklog,
+		drained:      make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		sizes:        opts.sizes,
+	}
+	if opts.RingReadBuffer > 0 {
+		r.buf = newRingBuffer(opts.RingReadBuffer)
+	} else {
+		r.buf = &sliceBuffer{}
 	}
 	go r.readLoopRearrange()
 	return r
 }
 
+// feedframes feeds all frames of the body into the reassembler. Counters are never checked per body:
+// a body may start at any counter, skip or repeat ones carried by other bodies (e.g. from another endpoint
+// after failover), only the global counter in readLoopRearrange decides the order
 func (c *readConn) feedframes(r io.ReadCloser) (datalen int, err error) {
 	count := 0
 	for {
@@ -58,18 +158,62 @@ func (c *readConn) feedframes(r io.ReadCloser) (datalen int, err error) {
 			c.feedError(err)
 			return 0, err
 		}
+		if c.onFrame != nil && f.options&optEnd == 0 {
+			c.onFrame(f.connIdx, f.options)
+		}
+		if f.options&optHello > 0 {
+			// Retried hello of an existing conn
+			continue
+		}
 		if f.idx == 0 {
+			if f.options&optEnd == 0 && c.endFrame {
+				// Stream ended without the end frame
+				c.feedError(ErrTruncated)
+				return 0, ErrTruncated
+			}
 			break
 		}
-		if c.closed {
+		if err, closed := c.status(); closed {
 			return 0, errClosedConn
+		} else if err != nil {
+			return 0, err
 		}
-		if c.err != nil {
-			return 0, c.err
+
+		if f.connIdx != c.idx {
+			// The body may carry frames of other connections, route them to their owners
+			var dst *readConn
+			if c.lookup != nil {
+				dst = c.lookup(f.connIdx)
+			}
+			if dst == nil || dst.blk != c.blk {
+				vprint(c, " drop frame of unknown connection: ", f)
+				continue
+			}
+			if err, closed := dst.status(); closed || err != nil {
+				vprint(c, " drop frame of closed connection: ", f)
+				continue
+			}
+			if len(f.data) > 0 && dst.budget.exceeded() {
+				return count, ErrMemoryLimit
+			}
+			c.sizes.observeReceived(len(f.data))
+			dst.hold(len(f.data))
+			if !dst.feedframe(f) {
+				dst.hold(-len(f.data))
+			}
+			count += len(f.data)
+			continue
 		}
 
-		debugprint("feed: ", f.data)
+		if len(f.data) > 0 && c.budget.exceeded() {
+			// Frames fed so far are kept, the rest will be dropped as duplicates when resent
+			return count, ErrMemoryLimit
+		}
+		debugprint("feed: ", payloadOf(f.data))
+		c.sizes.observeReceived(len(f.data))
+		c.hold(len(f.data))
 		if !c.feedframe(f) {
+			c.hold(-len(f.data))
 			return 0, errClosedConn
 		}
 		count += len(f.data)
@@ -88,16 +232,60 @@ func (c *readConn) feedframe(f frame) (ok bool) {
 			}
 		}
 	}()
+	if c.overflow == OverflowError {
+		select {
+		case c.frames <- f:
+		default:
+			c.feedError(ErrQueueFull)
+			return false
+		}
+		return true
+	}
 	c.frames <- f
 	return true
 }
 
 func (c *readConn) feedError(err error) {
+	c.Lock()
 	c.err = err
+	c.Unlock()
 	c.ready.Touch(dummyTouch)
 	c.close()
 }
 
+// status returns the stored error and whether the conn is closed, it is safe to call from any goroutine
+func (c *readConn) status() (err error, closed bool) {
+	c.Lock()
+	defer c.Unlock()
+	return c.err, c.closed
+}
+
+// delivered returns true if frames up to the counter have all been appended to the read buffer
+func (c *readConn) delivered(counter uint32) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.counter >= counter
+}
+
+// closeByPeer closes the conn because the peer has closed cleanly, e is nil if the peer hasn't given a code
+func (c *readConn) closeByPeer(e *CloseError) {
+	c.Lock()
+	if !c.peerClosed {
+		c.peerClosed, c.closeErr = true, e
+	}
+	c.Unlock()
+	c.close()
+}
+
+// shutdown closes the conn locally, any further Read will return errClosedConn
+func (c *readConn) shutdown() {
+	c.Lock()
+	c.localClosed = true
+	c.Unlock()
+	c.close()
+}
+
+// close stops receiving frames and wakes up the waiting Read
 func (c *readConn) close() {
 	c.Lock()
 	defer c.Unlock()
@@ -106,14 +294,93 @@ func (c *readConn) close() {
 	}
 	c.closed = true
 	close(c.frames)
+	close(c.done)
 	c.ready.SetWaitDeadline(time.Now())
+	c.signalDrained()
 }
 
+// holBlockedTime returns the total time delivery has been blocked by missing frames, including
+// the ongoing gap, c must be locked
+func (c *readConn) holBlockedTime() time.Duration {
+	d := c.holBlocked
+	if c.gapSince != 0 {
+		d += monotime() - c.gapSince
+	}
+	return time.Duration(d)
+}
+
+// buffered returns the number of bytes in buf
+func (c *readConn) buffered() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.buf.Len()
+}
+
+// countRecv counts the data delivered into buf, c must be locked
+func (c *readConn) countRecv(n int) {
+	if n > 0 {
+		c.recvBytes += uint64(n)
+		c.recvFrames++
+	}
+}
+
+// deliver appends data to buf, or drops them after closeRead, c must be locked
+func (c *readConn) deliver(data []byte) {
+	if c.readClosed {
+		c.hold(-len(data))
+		return
+	}
+	c.buf.Write(data)
+	c.countRecv(len(data))
+}
+
+// closeRead discards buffered and further incoming data, Read returns io.EOF afterwards.
+// Unlike shutdown, the conn is still open for writing
+func (c *readConn) closeRead() {
+	c.Lock()
+	c.readClosed = true
+	c.hold(-len(c.buf.Take()))
+	c.Unlock()
+	c.signalDrained()
+	c.ready.Touch(dummyTouch)
+}
+
+func (c *readConn) signalDrained() {
+	select {
+	case c.drained <- struct{}{}:
+	default:
+	}
+}
+
+// waitDrained blocks the rearranging while the backlog exceeds the limit, until Read catches up or the conn closes
+func (c *readConn) waitDrained() {
+	for c.backlog > 0 {
+		c.Lock()
+		full := c.buf.Len() > c.backlog && !c.closed
+		c.Unlock()
+		if !full {
+			return
+		}
+		<-c.drained
+	}
+}
+
+// readLoopRearrange is the only place where data are appended into the read buffer. Frames may arrive
+// out of order (from concurrent response bodies or retried requests), but they are always delivered
+// strictly by their counters: frame N+1 is appended only after frame N, duplicated frames are dropped.
+// So the bytes returned by Read are always in the same order as they were written on the other side.
+// In unordered mode, data of a frame are appended as soon as it arrives, only a marker is kept for
+// advancing the counter, so duplicated frames are still dropped
 func (c *readConn) readLoopRearrange() {
+	var gap <-chan time.Time // fires when the missing frame doesn't arrive in the reorder timeout
 LOOP:
 	select {
 	//		case <-time.After(time.Second * 10):
 	//			vprint("timeout")
+	case <-gap:
+		vprint(c, " missing frame: ", c.counter+1)
+		c.feedError(ErrReorderTimeout)
+		return
 	case f, ok := <-c.frames:
 		if !ok {
 			return
@@ -126,14 +393,21 @@ LOOP:
 			return
 		}
 
-		if f.idx <= c.counter {
+		if _, dup := c.futureframes[f.idx]; dup || f.idx <= c.counter {
+			// Duplicated frame (e.g. a retried request), drop it
+			c.hold(-len(f.data))
 			c.Unlock()
-			//c.feedError(fmt.Errorf("unmatched counter, maybe server GCed the connection"))
-			return
+			goto LOOP
+		}
+
+		if c.unordered && f.options&optClosed == 0 {
+			c.deliver(f.data)
+			f.data = nil
 		}
 
 		c.futureframes[f.idx] = f
 		c.futureSize += len(f.data)
+		counter := c.counter
 		for {
 			idx := c.counter + 1
 			if f, ok := c.futureframes[idx]; ok {
@@ -146,17 +420,26 @@ LOOP:
 					}
 					os.Remove(frameTmpPath(c.idx, f.idx))
 					f.data = buf
+					c.hold(len(buf))
 					vprint(c, " back load frame: ", f)
 				}
 
-				c.buf = append(c.buf, f.data...)
+				if f.options&optClosed > 0 {
+					// The close frame comes after all data
+					if !c.peerClosed {
+						c.peerClosed, c.closeErr = true, parseCloseError(f.data)
+					}
+					c.hold(-len(f.data))
+				} else {
+					c.deliver(f.data)
+				}
 				c.counter = f.idx
 				delete(c.futureframes, f.idx)
 				c.futureSize -= len(f.data)
 				continue
 			}
 
-			if c.futureSize > MaxReadBufferSize {
+			if c.futureSize > MaxReadBufferSize && len(f.data) > 0 {
 				if ioutil.WriteFile(frameTmpPath(c.idx, f.idx), f.data, 0755) != nil {
 					c.Unlock()
 					c.feedError(fmt.Errorf("fatal: missing certain frame"))
@@ -164,55 +447,222 @@ LOOP:
 				}
 
 				vprint(c, " tmp save frame: ", f)
+				c.hold(-len(f.data))
 				c.futureframes[f.idx] = frame{future: true, idx: f.idx}
 			}
 			break
 		}
+		if _, early := c.futureframes[f.idx]; early {
+			c.reordered++
+			if gap := f.idx - c.counter - 1; gap > c.maxGap {
+				c.maxGap = gap
+			}
+		}
+		if !c.unordered {
+			// Head-of-line blocking: while frames wait for a missing one, nothing after it can be delivered
+			if len(c.futureframes) > 0 && c.gapSince == 0 {
+				c.gapSince = monotime()
+			} else if len(c.futureframes) == 0 && c.gapSince != 0 {
+				c.holBlocked += monotime() - c.gapSince
+				c.gapSince = 0
+			}
+		}
 		if c.counter == 0xffffffff {
 			panic("surprise!")
 		}
+		if c.reorder > 0 {
+			// Frames after the gap have arrived, start waiting for the missing one
+			if len(c.futureframes) == 0 {
+				gap = nil
+			} else if gap == nil || c.counter != counter {
+				gap = time.After(c.reorder)
+			}
+		}
 		c.Unlock()
 		c.ready.Touch(dummyTouch)
+		c.waitDrained()
 	}
 	goto LOOP
 }
 
+// Read returns by the state of the conn, in the order of:
+//  1. closed locally: errClosedConn, buffered data are discarded
+//  2. data buffered: the data, even if the peer has closed, the conn has failed or the deadline is exceeded
+//  3. the peer has closed cleanly: io.EOF (*CloseError if the peer has given a code), until closed locally
+//  4. failed: the error
+//  5. closed otherwise (e.g. purged): errClosedConn
+//  6. deadline exceeded: timeout error
+//  7. otherwise: wait for any of the above
 func (c *readConn) Read(p []byte) (n int, err error) {
-READ:
-	if c.closed {
-		return 0, errClosedConn
+	for {
+		if c.coalesce > 0 && len(p) > 0 {
+			c.waitCoalesce(len(p))
+		}
+
+		if n, err, ok := c.readState(p); ok {
+			return n, err
+		}
+
+		if err := c.ctxErr(); err != nil {
+			return 0, err
+		}
+
+		if c.ready.IsTimedout() {
+			return 0, &timeoutError{}
+		}
+
+		c.Lock()
+		useTimeout := c.deadline.IsZero() && c.timeout > 0
+		c.Unlock()
+
+		if useTimeout {
+			c.ready.SetWaitDeadline(time.Now().Add(c.timeout))
+		}
+
+		_, ontime := c.ready.Wait()
+
+		if useTimeout {
+			c.ready.SetWaitDeadline(time.Time{})
+		}
+
+		if !ontime {
+			// Either the deadline is exceeded, or the conn is closed
+			if n, err, ok := c.readState(p); ok {
+				return n, err
+			}
+			return 0, &timeoutError{}
+		}
 	}
+}
 
-	if c.err != nil {
-		return 0, c.err
+// waitCoalesce waits until n bytes are buffered, or the coalesce duration passes, if some data are buffered.
+// It returns early when the conn is closed, failed or the deadline is exceeded
+func (c *readConn) waitCoalesce(n int) {
+	step := c.coalesce / 10
+	if step > time.Millisecond {
+		step = time.Millisecond
 	}
+	deadline := time.Now().Add(c.coalesce)
+	for {
+		c.Lock()
+		buffered, done := c.buf.Len(), c.closed || c.err != nil || c.peerClosed
+		c.Unlock()
 
-	if c.ready.IsTimedout() {
-		return 0, &timeoutError{}
+		if buffered == 0 || buffered >= n || done || c.ready.IsTimedout() || !time.Now().Before(deadline) {
+			return
+		}
+		time.Sleep(step)
 	}
+}
 
+// readState returns ok == false if Read should wait
+func (c *readConn) readState(p []byte) (n int, err error, ok bool) {
 	c.Lock()
-	if len(c.buf) > 0 {
-		n = copy(p, c.buf)
-		c.buf = c.buf[n:]
+	defer c.Unlock()
+
+	switch {
+	case c.localClosed:
+		return 0, errClosedConn, true
+	case c.readClosed:
+		return 0, io.EOF, true
+	case c.buf.Len() > 0:
+		n = c.buf.Read(p)
+		c.hold(-n)
+		c.signalDrained()
+		return n, nil, true
+	case c.peerClosed:
+		if c.closeErr != nil {
+			return 0, c.closeErr, true
+		}
+		return 0, io.EOF, true
+	case c.err != nil:
+		return 0, c.err, true
+	case c.closed:
+		return 0, errClosedConn, true
+	}
+	return 0, nil, false
+}
+
+// WriteTo writes data to w directly from the read buffer, it returns when the conn is closed or an error occurs
+func (c *readConn) WriteTo(w io.Writer) (n int64, err error) {
+	for {
+		c.Lock()
+		buf := c.buf.Take()
+		c.hold(-len(buf))
 		c.Unlock()
-		return
+		c.signalDrained()
+
+		if len(buf) > 0 {
+			nw, ew := w.Write(buf)
+			n += int64(nw)
+			if ew != nil {
+				return n, ew
+			}
+			continue
+		}
+
+		// Wait for the incoming data
+		if _, err = c.Read(nil); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
 	}
-	c.Unlock()
+}
 
-	_, ontime := c.ready.Wait()
+// setContext makes the waiting and further Read return ctx.Err() once ctx is done, buffered data are still
+// returned first. The conn is not closed by ctx
+func (c *readConn) setContext(ctx context.Context) {
+	c.Lock()
+	c.ctx = ctx
+	c.Unlock()
 
-	if c.closed {
-		return 0, errClosedConn
+	if ctx.Done() == nil {
+		return
 	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.ready.Touch(dummyTouch)
+		case <-c.done:
+		}
+	}()
+}
 
-	if !ontime {
-		return 0, &timeoutError{}
+func (c *readConn) ctxErr() error {
+	c.Lock()
+	ctx := c.ctx
+	c.Unlock()
+	if ctx == nil {
+		return nil
 	}
+	return ctx.Err()
+}
+
+func (c *readConn) setReadDeadline(t time.Time) {
+	c.Lock()
+	c.deadline = t
+	c.Unlock()
+	c.ready.SetWaitDeadline(t)
+}
 
-	goto READ
+// setLogTag replaces the index in logs of the conn by tag, or restores it if tag is empty
+func (c *readConn) setLogTag(tag string) {
+	c.logTag.Store(tag)
+}
+
+// logTagOr returns the tag set by setLogTag, or def if not set
+func (c *readConn) logTagOr(def string) string {
+	if tag, _ := c.logTag.Load().(string); tag != "" {
+		return tag
+	}
+	return def
 }
 
 func (c *readConn) String() string {
+	if tag := c.logTagOr(""); tag != "" {
+		return fmt.Sprintf("<%s:%s,ctr:%d>", string(c.tag), tag, c.counter)
+	}
 	return fmt.Sprintf("<%s,ctr:%d>", string(c.tag), c.counter)
 }
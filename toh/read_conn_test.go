@@ -0,0 +1,426 @@
+package toh
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestReadConnOrdering(t *testing.T) {
+	blk, _ := aes.NewCipher(make([]byte, 16))
+	c := newReadConn(1, blk, 'c', &CommonOptions{FrameQueueSize: 16})
+
+	var expected []byte
+	var frames []*frame
+	for i := 1; i <= 500; i++ {
+		f := &frame{idx: uint32(i), connIdx: 1, data: make([]byte, rand.Intn(100)+1)}
+		rand.Read(f.data)
+		expected = append(expected, f.data...)
+		frames = append(frames, f)
+	}
+
+	// Duplicate some frames, then spread all frames across bodies in random order
+	for i := 0; i < 50; i++ {
+		f := *frames[rand.Intn(len(frames))]
+		frames = append(frames, &f)
+	}
+	rand.Shuffle(len(frames), func(i, j int) { frames[i], frames[j] = frames[j], frames[i] })
+
+	bodies := make([][]*frame, 4)
+	for _, f := range frames {
+		i := rand.Intn(len(bodies))
+		bodies[i] = append(bodies[i], f)
+	}
+
+	for _, frames := range bodies {
+		body := &bytes.Buffer{}
+		for _, f := range frames {
+			// marshal encrypts data in place, so copy it first
+			f := &frame{idx: f.idx, connIdx: f.connIdx, data: append([]byte{}, f.data...)}
+			io.Copy(body, f.marshal(blk))
+		}
+		io.Copy(body, endframe.marshal(blk))
+		go c.feedframes(ioutil.NopCloser(body))
+	}
+
+	c.setReadDeadline(time.Now().Add(time.Second * 5))
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, expected) {
+		t.Fatal("unmatched data")
+	}
+}
+
+func TestReadConnUnordered(t *testing.T) {
+	blk, _ := aes.NewCipher(make([]byte, 16))
+	c := newReadConn(1, blk, 'c', &CommonOptions{FrameQueueSize: 16, Unordered: true})
+
+	feed := func(frames ...frame) {
+		body := &bytes.Buffer{}
+		for _, f := range frames {
+			io.Copy(body, f.marshal(blk))
+		}
+		io.Copy(body, endframe.marshal(blk))
+		c.feedframes(ioutil.NopCloser(body))
+	}
+
+	read := func(expected string) {
+		c.setReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, len(expected))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != expected {
+			t.Fatal("unmatched data:", string(buf), "expected:", expected)
+		}
+	}
+
+	// Frame 1 is delayed, but frame 3 and 2 should be delivered right away
+	feed(frame{idx: 3, connIdx: 1, data: []byte("ccc")})
+	read("ccc")
+	feed(frame{idx: 2, connIdx: 1, data: []byte("bb")})
+	read("bb")
+
+	// Duplicated frames are still dropped
+	feed(frame{idx: 1, connIdx: 1, data: []byte("a")},
+		frame{idx: 3, connIdx: 1, data: []byte("ccc")},
+		frame{idx: 4, connIdx: 1, data: []byte("dddd")})
+	read("adddd")
+	if c.counter != 4 {
+		t.Fatal("counter not advanced:", c.counter)
+	}
+}
+
+func TestReadConnStates(t *testing.T) {
+	blk, _ := aes.NewCipher(make([]byte, 16))
+	timeout := &timeoutError{}
+
+	type step struct {
+		do   func(c *readConn, feed func(...frame))
+		data string
+		err  error
+	}
+
+	data := func(idx uint32, s string) func(*readConn, func(...frame)) {
+		return func(c *readConn, feed func(...frame)) { feed(frame{idx: idx, connIdx: 1, data: []byte(s)}) }
+	}
+	closeFrame := func(idx uint32, e *CloseError) func(*readConn, func(...frame)) {
+		return func(c *readConn, feed func(...frame)) {
+			feed(frame{idx: idx, connIdx: 1, options: optClosed, data: e.marshal()})
+		}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		steps []step
+	}{
+		{"peer close after data", []step{
+			{do: data(1, "abc"), data: "abc"},
+			{do: func(c *readConn, _ func(...frame)) { c.closeByPeer(nil) }, err: io.EOF},
+			{err: io.EOF},
+			{do: func(c *readConn, _ func(...frame)) { c.shutdown() }, err: errClosedConn},
+		}},
+		{"data buffered before peer close", []step{
+			{do: func(c *readConn, feed func(...frame)) {
+				data(1, "abc")(c, feed)
+				time.Sleep(100 * time.Millisecond)
+				c.closeByPeer(nil)
+			}, data: "abc"},
+			{err: io.EOF},
+		}},
+		{"peer close with code", []step{
+			{do: func(c *readConn, _ func(...frame)) { c.closeByPeer(&CloseError{Code: 1, Reason: "bye"}) },
+				err: &CloseError{Code: 1, Reason: "bye"}},
+			{err: &CloseError{Code: 1, Reason: "bye"}},
+		}},
+		{"in-order close frame", []step{
+			{do: closeFrame(3, nil), err: timeout},
+			{do: data(2, "b"), err: timeout},
+			{do: data(1, "a"), data: "ab"},
+			{err: io.EOF},
+		}},
+		{"in-order close frame with code", []step{
+			{do: data(1, "a"), data: "a"},
+			{do: closeFrame(2, &CloseError{Code: 2}), err: &CloseError{Code: 2}},
+		}},
+		{"failure after data", []step{
+			{do: func(c *readConn, feed func(...frame)) {
+				data(1, "abc")(c, feed)
+				time.Sleep(100 * time.Millisecond)
+				c.feedError(ErrCloseNotAcked)
+			}, data: "abc"},
+			{err: ErrCloseNotAcked},
+		}},
+		{"local close", []step{
+			{do: func(c *readConn, feed func(...frame)) {
+				data(1, "abc")(c, feed)
+				time.Sleep(100 * time.Millisecond)
+				c.shutdown()
+			}, err: errClosedConn},
+		}},
+		{"closed without reason", []step{
+			{do: func(c *readConn, _ func(...frame)) { c.close() }, err: errClosedConn},
+		}},
+		{"timeout then data", []step{
+			{err: timeout},
+			{do: data(1, "abc"), data: "abc"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newReadConn(1, blk, 'c', &CommonOptions{FrameQueueSize: 16})
+			defer c.close()
+
+			feed := func(frames ...frame) {
+				body := &bytes.Buffer{}
+				for _, f := range frames {
+					io.Copy(body, f.marshal(blk))
+				}
+				io.Copy(body, endframe.marshal(blk))
+				c.feedframes(ioutil.NopCloser(body))
+			}
+
+			for i, s := range tc.steps {
+				if s.do != nil {
+					s.do(c, feed)
+				}
+				c.setReadDeadline(time.Now().Add(200 * time.Millisecond))
+				buf := make([]byte, 16)
+				n, err := c.Read(buf)
+				if string(buf[:n]) != s.data || fmt.Sprint(err) != fmt.Sprint(s.err) {
+					t.Fatalf("step #%d: got %q, %v, expected %q, %v", i, buf[:n], err, s.data, s.err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadConnReorderTimeout(t *testing.T) {
+	blk, _ := aes.NewCipher(make([]byte, 16))
+	c := newReadConn(1, blk, 'c', &CommonOptions{FrameQueueSize: 16, ReorderTimeout: 200 * time.Millisecond})
+
+	feed := func(frames ...frame) {
+		body := &bytes.Buffer{}
+		for _, f := range frames {
+			io.Copy(body, f.marshal(blk))
+		}
+		io.Copy(body, endframe.marshal(blk))
+		c.feedframes(ioutil.NopCloser(body))
+	}
+
+	// The missing frame arrives in time
+	feed(frame{idx: 2, connIdx: 1, data: []byte("b")})
+	time.Sleep(100 * time.Millisecond)
+	feed(frame{idx: 1, connIdx: 1, data: []byte("a")})
+
+	c.setReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ab" {
+		t.Fatal(string(buf), err)
+	}
+
+	// Frame 3 is skipped
+	start := time.Now()
+	feed(frame{idx: 4, connIdx: 1, data: []byte("d")})
+	c.setReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(buf); err != ErrReorderTimeout {
+		t.Fatal("expected reorder timeout:", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatal("unexpected elapsed:", elapsed)
+	}
+}
+
+func TestReadConnBodySwitch(t *testing.T) {
+	blk, _ := aes.NewCipher(make([]byte, 16))
+	c := newReadConn(1, blk, 'c', &CommonOptions{FrameQueueSize: 16})
+
+	body := func(from, to uint32) io.ReadCloser {
+		buf := &bytes.Buffer{}
+		for i := from; i <= to; i++ {
+			f := frame{idx: i, connIdx: 1, data: []byte{byte('a' + i - 1)}}
+			io.Copy(buf, f.marshal(blk))
+		}
+		io.Copy(buf, endframe.marshal(blk))
+		return ioutil.NopCloser(buf)
+	}
+
+	// The old endpoint delivers 1-4, the new one resends 3-6 of the same stream and continues with 7-8,
+	// which arrive before 3-6
+	for _, b := range []io.ReadCloser{body(1, 4), body(7, 8), body(3, 6)} {
+		if _, err := c.feedframes(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.setReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "abcdefgh" {
+		t.Fatal(string(buf), err)
+	}
+
+	// 7 and 8 waited for 5, which was expected
+	if c.reordered != 2 || c.maxGap != 3 {
+		t.Fatal(c.reordered, c.maxGap)
+	}
+}
+
+func TestReadConnHOLBlocked(t *testing.T) {
+	blk, _ := aes.NewCipher(make([]byte, 16))
+	c := newReadConn(1, blk, 'c', &CommonOptions{FrameQueueSize: 16})
+
+	feed := func(idx uint32) {
+		buf := &bytes.Buffer{}
+		f := frame{idx: idx, connIdx: 1, data: []byte{byte('a' + idx - 1)}}
+		io.Copy(buf, f.marshal(blk))
+		io.Copy(buf, endframe.marshal(blk))
+		if _, err := c.feedframes(ioutil.NopCloser(buf)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 2 waits for 1
+	feed(2)
+	time.Sleep(200 * time.Millisecond)
+	feed(1)
+
+	c.setReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ab" {
+		t.Fatal(string(buf), err)
+	}
+	c.Lock()
+	hol := c.holBlockedTime()
+	c.Unlock()
+	if hol < 200*time.Millisecond || hol > time.Second {
+		t.Fatal(hol)
+	}
+}
+
+func TestReadConnCoalesce(t *testing.T) {
+	blk, _ := aes.NewCipher(make([]byte, 16))
+	c := newReadConn(1, blk, 'c', &CommonOptions{FrameQueueSize: 16, ReadCoalesce: 500 * time.Millisecond})
+
+	feed := func(f frame) {
+		body := &bytes.Buffer{}
+		io.Copy(body, f.marshal(blk))
+		io.Copy(body, endframe.marshal(blk))
+		c.feedframes(ioutil.NopCloser(body))
+	}
+
+	feed(frame{idx: 1, connIdx: 1, data: []byte("ab")})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		feed(frame{idx: 2, connIdx: 1, data: []byte("cd")})
+	}()
+
+	// Both frames are returned by a single Read
+	buf := make([]byte, 4)
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "abcd" {
+		t.Fatal(string(buf[:n]), err)
+	}
+
+	// The deadline cuts the wait short
+	feed(frame{idx: 3, connIdx: 1, data: []byte("e")})
+	c.setReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "e" || time.Since(start) > 300*time.Millisecond {
+		t.Fatal(string(buf[:n]), err, time.Since(start))
+	}
+}
+
+func TestReadConnBacklog(t *testing.T) {
+	blk, _ := aes.NewCipher(make([]byte, 16))
+	c := newReadConn(1, blk, 'c', &CommonOptions{FrameQueueSize: 4, MaxReadBacklog: 1024})
+
+	// 64 frames of 256 bytes in a single body, fed while the reader stalls
+	const n, size = 64, 256
+	body := &bytes.Buffer{}
+	for i := 1; i <= n; i++ {
+		f := frame{idx: uint32(i), connIdx: 1, data: bytes.Repeat([]byte{byte(i)}, size)}
+		io.Copy(body, f.marshal(blk))
+	}
+	io.Copy(body, endframe.marshal(blk))
+
+	fed := make(chan error, 1)
+	go func() {
+		_, err := c.feedframes(ioutil.NopCloser(body))
+		fed <- err
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case err := <-fed:
+		t.Fatal("body is consumed while the reader stalls: ", err)
+	default:
+	}
+	c.Lock()
+	buffered := c.buf.Len()
+	c.Unlock()
+	if buffered > 1024+size {
+		t.Fatal("backlog grows: ", buffered)
+	}
+
+	// The reader catches up, everything arrives in order
+	buf := make([]byte, n*size)
+	c.setReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := range buf {
+		if buf[i] != byte(i/size+1) {
+			t.Fatal("corrupted at ", i)
+		}
+	}
+	if err := <-fed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadConnContext(t *testing.T) {
+	blk, _ := aes.NewCipher(make([]byte, 16))
+	c := newReadConn(1, blk, 'c', &CommonOptions{FrameQueueSize: 4})
+	defer c.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.setContext(ctx)
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 16))
+		read <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	cancel()
+	select {
+	case err := <-read:
+		if err != context.Canceled {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d > 50*time.Millisecond {
+			t.Fatal("slow wake up: ", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read is not interrupted")
+	}
+
+	// Buffered data still come first
+	c.feedframe(frame{idx: 1, connIdx: 1, data: []byte("hello")})
+	time.Sleep(50 * time.Millisecond)
+	buf := make([]byte, 16)
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatal(n, err)
+	}
+	if _, err := c.Read(buf); err != context.Canceled {
+		t.Fatal(err)
+	}
+}
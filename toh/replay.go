@@ -0,0 +1,137 @@
+package toh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	helloWindow   = 30 * time.Second // max clock difference between the dialer and the listener
+	helloDataSize = 16               // timestamp 8b | nonce 8b, followed by version 1b | flags 1b | client version
+)
+
+// MaxClientVersion is the max length of Dialer.ClientVersion carried by hellos
+const MaxClientVersion = 64
+
+// helloEarlyData in hello flags marks the data frame following the hello, see DialEarly.
+// The server acknowledges it by the same flag following the version in the ack
+const helloEarlyData = 1
+
+// helloDataKey in hello flags tells the server that data frames are encrypted by DataKey,
+// the server acknowledges it the same way
+const helloDataKey = 2
+
+// helloEarlyKey in hello flags tells the server that early data are encrypted by HelloKey
+const helloEarlyKey = 4
+
+// helloEndFrame in hello flags tells the server that frame streams of the client are terminated by
+// the end frame, the server acknowledges it the same way. Both sides always write end frames, peers
+// unaware of them take them as the usual terminator, but only require them once negotiated
+const helloEndFrame = 8
+
+// ErrDataKeyUnsupported is returned by Dial when the server doesn't acknowledge DataKey
+var ErrDataKeyUnsupported = fmt.Errorf("data key not supported by the server")
+
+// MaxEarlyData is the max size of data carried by the hello, see DialEarly
+const MaxEarlyData = 16 << 10
+
+// ErrEarlyDataTooLarge is returned by DialEarly when the data exceed MaxEarlyData
+var ErrEarlyDataTooLarge = fmt.Errorf("early data too large")
+
+// helloAckMessage is what the signature of the ack covers: the timestamp and nonce of the hello,
+// so the signature can't be replayed to another hello, the conn and the ack itself
+func helloAckMessage(hello []byte, connIdx uint64, ack []byte) []byte {
+	msg := make([]byte, helloDataSize+8, helloDataSize+8+len(ack))
+	copy(msg, hello[:helloDataSize])
+	binary.BigEndian.PutUint64(msg[helloDataSize:], connIdx)
+	return append(msg, ack...)
+}
+
+// signHelloAck appends the signature to the ack data: version 1b | flags 1b | signature, see Listener.SigningKey
+func signHelloAck(key ed25519.PrivateKey, hello []byte, connIdx uint64, ack []byte) []byte {
+	return append(ack, ed25519.Sign(key, helloAckMessage(hello, connIdx, ack))...)
+}
+
+// verifyHelloAck returns true if the ack is signed by the key, see Dialer.ServerKey
+func verifyHelloAck(key ed25519.PublicKey, hello []byte, connIdx uint64, ack []byte) bool {
+	n := len(ack) - ed25519.SignatureSize
+	if n < 2 || len(hello) < helloDataSize {
+		return false
+	}
+	return ed25519.Verify(key, helloAckMessage(hello, connIdx, ack[:n]), ack[n:])
+}
+
+// newHelloData returns the timestamp and a random nonce carried by hello frames
+func newHelloData() []byte {
+	buf := make([]byte, helloDataSize)
+	binary.BigEndian.PutUint64(buf, uint64(wallclock().UnixNano()))
+	rand.Read(buf[8:])
+	return buf
+}
+
+// replayCache remembers nonces of hellos seen in the window, so replayed hellos can be rejected.
+// It holds at most max nonces, the oldest will be evicted when it is full
+type replayCache struct {
+	mu     sync.Mutex
+	seen   map[uint64]int64
+	order  []uint64 // ring of nonces in arrival order
+	head   int
+	max    int
+	window time.Duration
+	skews  uint64 // hellos out of the window
+}
+
+func newReplayCache(max int, window time.Duration) *replayCache {
+	return &replayCache{
+		seen:   make(map[uint64]int64, max),
+		order:  make([]uint64, 0, max),
+		max:    max,
+		window: window,
+	}
+}
+
+// check returns false if the hello data is malformed, out of the window, or has been seen
+func (rc *replayCache) check(data []byte) bool {
+	if len(data) < helloDataSize {
+		return false
+	}
+
+	// Both are wall clocks of different machines, this is the only place they are compared
+	now := wallclock().UnixNano()
+	ts := int64(binary.BigEndian.Uint64(data))
+	if ts < now-int64(rc.window) || ts > now+int64(rc.window) {
+		atomic.AddUint64(&rc.skews, 1)
+		vprint("hello out of the window, the dialer's clock is off by ", time.Duration(ts-now))
+		return false
+	}
+
+	nonce := binary.BigEndian.Uint64(data[8:])
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if exp, ok := rc.seen[nonce]; ok && exp > now {
+		return false
+	}
+
+	expire := ts + int64(rc.window)
+	if _, ok := rc.seen[nonce]; ok {
+		// Expired one, still in the ring
+		rc.seen[nonce] = expire
+		return true
+	}
+	if len(rc.order) < rc.max {
+		rc.order = append(rc.order, nonce)
+	} else {
+		delete(rc.seen, rc.order[rc.head])
+		rc.order[rc.head] = nonce
+		rc.head = (rc.head + 1) % rc.max
+	}
+	rc.seen[nonce] = expire
+	return true
+}
@@ -0,0 +1,49 @@
+package toh
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+)
+
+// RoundTrip sends the request through a tunnel conn to address and returns the whole response, see Dialer.RoundTrip.
+// Dialers are shared among calls with the same network and address, like DialWrap
+func RoundTrip(ctx context.Context, network, address string, request []byte) ([]byte, error) {
+	return sharedDialer(network, address).RoundTrip(ctx, request)
+}
+
+// RoundTrip serves request/response protocols in a single call: it dials a conn, writes the request, closes
+// the writing side and reads the response until the server side closes its own (by CloseWrite or Close),
+// then closes the conn. A request of at most MaxEarlyData is carried by the hello, saving a round trip.
+// ctx bounds the whole exchange. The server side should read the request until io.EOF before responding
+func (d *Dialer) RoundTrip(ctx context.Context, request []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if len(request) <= MaxEarlyData {
+		conn, err = d.DialEarly(ctx, request)
+	} else if conn, err = d.DialContext(ctx); err == nil {
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetWriteDeadline(deadline)
+		}
+		_, err = conn.Write(request)
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+	defer conn.Close()
+
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); err != nil {
+			return nil, err
+		}
+	}
+	if c, ok := conn.(interface{ SetContext(context.Context) }); ok {
+		c.SetContext(ctx)
+	} else if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	}
+	return ioutil.ReadAll(conn)
+}
@@ -0,0 +1,70 @@
+package toh
+
+import (
+	"sync"
+	"time"
+
+	"github.com/coyove/common/sched"
+)
+
+// scheduler runs f after d, and returns the function canceling it. All timers of the package
+// (flushing, purging, closing stalled bodies) go through defaultScheduler, tests may replace it by setScheduler
+type scheduler interface {
+	Schedule(f func(), d time.Duration) (cancel func())
+}
+
+var (
+	defaultScheduler   scheduler = commonScheduler{}
+	defaultSchedulerMu sync.RWMutex
+)
+
+// currentScheduler returns defaultScheduler, it is safe to call while setScheduler is replacing it
+func currentScheduler() scheduler {
+	defaultSchedulerMu.RLock()
+	defer defaultSchedulerMu.RUnlock()
+	return defaultScheduler
+}
+
+// setScheduler replaces defaultScheduler by s and returns the old one
+func setScheduler(s scheduler) (old scheduler) {
+	defaultSchedulerMu.Lock()
+	defer defaultSchedulerMu.Unlock()
+	old, defaultScheduler = defaultScheduler, s
+	return old
+}
+
+// commonScheduler is backed by github.com/coyove/common/sched
+type commonScheduler struct{}
+
+func (commonScheduler) Schedule(f func(), d time.Duration) func() {
+	return sched.Schedule(f, d).Cancel
+}
+
+// schedKey is a scheduled function, its zero value schedules nothing. It is safe for concurrent use,
+// at most one function is scheduled by the key at any time
+type schedKey struct {
+	mu     sync.Mutex
+	cancel func()
+}
+
+func schedule(f func(), d time.Duration) *schedKey {
+	return &schedKey{cancel: currentScheduler().Schedule(f, d)}
+}
+
+func (k *schedKey) Cancel() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.cancel != nil {
+		k.cancel()
+		k.cancel = nil
+	}
+}
+
+func (k *schedKey) Reschedule(f func(), d time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.cancel != nil {
+		k.cancel()
+	}
+	k.cancel = currentScheduler().Schedule(f, d)
+}
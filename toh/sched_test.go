@@ -0,0 +1,133 @@
+package toh
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeScheduler runs scheduled functions only when Advance is called
+type fakeScheduler struct {
+	mu    sync.Mutex
+	now   time.Duration
+	seq   int
+	tasks map[int]fakeTask
+}
+
+type fakeTask struct {
+	at time.Duration
+	f  func()
+}
+
+func newFakeScheduler() *fakeScheduler {
+	return &fakeScheduler{tasks: map[int]fakeTask{}}
+}
+
+// useFakeScheduler replaces defaultScheduler, until restore is called
+func useFakeScheduler() (s *fakeScheduler, restore func()) {
+	s = newFakeScheduler()
+	old := setScheduler(s)
+	return s, func() { setScheduler(old) }
+}
+
+func (s *fakeScheduler) Schedule(f func(), d time.Duration) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	id := s.seq
+	s.tasks[id] = fakeTask{at: s.now + d, f: f}
+	return func() {
+		s.mu.Lock()
+		delete(s.tasks, id)
+		s.mu.Unlock()
+	}
+}
+
+// Advance moves the fake time forward and runs the due functions in order, in the calling goroutine
+func (s *fakeScheduler) Advance(d time.Duration) {
+	s.mu.Lock()
+	s.now += d
+	var due []int
+	for id, task := range s.tasks {
+		if task.at <= s.now {
+			due = append(due, id)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		a, b := s.tasks[due[i]], s.tasks[due[j]]
+		return a.at < b.at || a.at == b.at && due[i] < due[j]
+	})
+	var fs []func()
+	for _, id := range due {
+		fs = append(fs, s.tasks[id].f)
+		delete(s.tasks, id)
+	}
+	s.mu.Unlock()
+
+	for _, f := range fs {
+		f()
+	}
+}
+
+func TestSchedKey(t *testing.T) {
+	s, restore := useFakeScheduler()
+	defer restore()
+
+	var fired []string
+	var k schedKey
+	k.Cancel() // the zero value is fine
+
+	k.Reschedule(func() { fired = append(fired, "a") }, time.Second)
+	s.Advance(500 * time.Millisecond)
+	k.Reschedule(func() { fired = append(fired, "b") }, time.Second)
+	s.Advance(500 * time.Millisecond)
+	if len(fired) != 0 {
+		t.Fatal("rescheduled function fired:", fired)
+	}
+
+	other := schedule(func() { fired = append(fired, "c") }, 100*time.Millisecond)
+	s.Advance(500 * time.Millisecond)
+	if len(fired) != 2 || fired[0] != "c" || fired[1] != "b" {
+		t.Fatal("unexpected order:", fired)
+	}
+
+	other.Cancel() // already fired
+	k.Reschedule(func() { fired = append(fired, "d") }, time.Second)
+	k.Cancel()
+	s.Advance(time.Hour)
+	if len(fired) != 2 {
+		t.Fatal("canceled function fired:", fired)
+	}
+}
+
+// Run with -race
+func TestSchedKeyConcurrent(t *testing.T) {
+	s, restore := useFakeScheduler()
+	defer restore()
+
+	var k schedKey
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if i%4 == 0 {
+					k.Cancel()
+				} else {
+					k.Reschedule(func() {}, time.Second)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// No timer is leaked by racing reschedules
+	k.Cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tasks) != 0 {
+		t.Fatal("leaked timers: ", len(s.tasks))
+	}
+}
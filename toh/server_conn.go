@@ -2,19 +2,26 @@ package toh
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/coyove/common/sched"
 )
 
+// payloadHeader carries the payload of GET requests
+const payloadHeader = "X-Request-Data"
+
 const (
 	PING_OK uint16 = iota + 1
 	PING_CLOSED
@@ -24,26 +31,56 @@ const (
 type ServerConn struct {
 	idx        uint64
 	rev        *Listener
-	schedPurge sched.SchedKey
+	network    string
+	key        cipher.Block // the key which authenticated the conn
+	remote     net.Addr     // address of the client which said hello
+	proto      string       // "http" or "https", the scheme of the hello request
+	clientVer  string       // see Dialer.ClientVersion
+	created    time.Time
+	retry      time.Duration // how long a response is retried before the conn fails, see TimeoutJitter
+	schedPurge schedKey
+	closeOnce  sync.Once
 
 	write struct {
 		sync.Mutex
-		buf     []byte
-		counter uint32
+		buf      []byte
+		counter  uint32
+		closing  *CloseError // sent to the client after buf is flushed, see CloseWithError
+		closed   bool        // CloseWrite has been called
+		dropped  bool        // the client has called CloseRead, buf is discarded
+		eof      bool        // the EOF frame is yet to be sent, see CloseWrite
+		notify   chan bool   // signaled when new data are written, see Listener.PushHold
+		holding  int32       // 1 if a response is being held
+		deadline writeDeadline
 	}
 
 	read *readConn
 }
 
-func newServerConn(idx uint64, ln *Listener) *ServerConn {
-	c := &ServerConn{idx: idx}
+func newServerConn(idx uint64, ln *Listener, n lnNetwork) *ServerConn {
+	c := &ServerConn{idx: idx, network: n.name, key: n.blk, created: time.Now()}
+	c.retry = jitter(ln.Timeout-time.Second, ln.TimeoutJitter)
+	c.write.notify = make(chan bool, 1)
 	c.rev = ln
-	c.read = newReadConn(c.idx, ln.blk, 's')
+	c.read = newReadConn(c.idx, n.blk, 's', &ln.CommonOptions)
+	c.read.lookup = ln.lookupReadConn
+	c.read.onFrame = ln.OnFrame
+	c.read.budget = ln.budget
 	return c
 }
 
+func (l *Listener) lookupReadConn(connIdx uint64) *readConn {
+	l.connsmu.Lock()
+	defer l.connsmu.Unlock()
+	if c := l.conns[connIdx]; c != nil {
+		return c.read
+	}
+	return nil
+}
+
 func (l *Listener) randomReply(w http.ResponseWriter, r *http.Request) {
 	vprint("listener random reply: ", r)
+	atomic.AddUint64(&l.httpStats.BadRequests, 1)
 
 	if l.OnBadRequest != nil {
 		l.OnBadRequest(w, r)
@@ -60,15 +97,23 @@ func (l *Listener) randomReply(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (l *Listener) healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
 func (l *Listener) handler(w http.ResponseWriter, r *http.Request) {
-	if l.URLPath != "" && r.URL.Path != l.URLPath {
+	atomic.AddUint64(&l.httpStats.Requests, 1)
+	n, ok := l.networkOf(r.URL.Path)
+	if !ok {
 		l.randomReply(w, r)
 		return
 	}
 
-	if strings.ToLower(r.Header.Get("Sec-WebSocket-Key")) != "" {
-		conn, err := l.wsHandShake(w, r)
+	if l.WebSocket && strings.ToLower(r.Header.Get("Sec-WebSocket-Key")) != "" {
+		conn, err := l.wsHandShake(w, r, n.blk)
 		if err != nil {
+			atomic.AddUint64(&l.httpStats.Non200, 1)
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(err.Error()))
 		} else {
@@ -77,30 +122,109 @@ func (l *Listener) handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hdr, ok := parseframe(r.Body, l.blk)
-	if !ok {
+	if !l.allowMethod(r.Method) {
+		atomic.AddUint64(&l.httpStats.Non200, 1)
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == "GET" {
+		buf, err := base64.RawURLEncoding.DecodeString(r.Header.Get(payloadHeader))
+		if err != nil {
+			l.randomReply(w, r)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(buf))
+	}
+
+	hdr, blk, err := parseframeAny(r.Body, l.blocksOf(n)...)
+	if err != nil || blk == nil {
+		if err == errFrameAuth {
+			atomic.AddUint64(&l.httpStats.AuthFailures, 1)
+			if l.OnBadRequest == nil {
+				// Most likely a dialer of another key, tell it clearly, see ErrAuthFailed
+				atomic.AddUint64(&l.httpStats.Non200, 1)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		} else {
+			atomic.AddUint64(&l.httpStats.Malformed, 1)
+		}
 		l.randomReply(w, r)
 		return
 	}
+	// From now on, we use the key which decrypted the frame
+	n.blk = blk
+	if l.OnFrame != nil {
+		l.OnFrame(hdr.connIdx, hdr.options)
+	}
 
-	switch hdr.options {
+	switch hdr.options &^ OptUserMask {
 	case optSyncConnIdx:
 	case optClosed:
 		l.connsmu.Lock()
-		c := l.conns[hdr.connIdx]
+		c := l.connOf(n, hdr.connIdx)
 		l.connsmu.Unlock()
-		if c != nil {
-			vprint(c, " is closing because the other side has closed")
-			c.Close()
+		if c == nil {
+			l.randomReply(w, r)
+			return
 		}
+		vprint(c, " is closing because the other side has closed")
+		c.read.closeByPeer(parseCloseError(hdr.data))
+		c.teardown()
+		// Acknowledge the close
+		f := frame{connIdx: hdr.connIdx, options: optClosed, version: hdr.version}
+		io.Copy(w, f.marshal(n.blk))
+		return
+	case optBarrier:
+		l.connsmu.Lock()
+		c := l.connOf(n, hdr.connIdx)
+		l.connsmu.Unlock()
+		if c == nil || len(hdr.data) < 4 {
+			return
+		}
+		c.reschedDeath()
+
+		// Frames sent before may still be on the way to, or waiting in the reassembler
+		counter := binary.BigEndian.Uint32(hdr.data)
+		deadline := time.Now().Add(l.Timeout)
+		for !c.read.delivered(counter) {
+			if c.read.closed || time.Now().After(deadline) || r.Context().Err() != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		ack := make([]byte, 4)
+		binary.BigEndian.PutUint32(ack, counter)
+		f := frame{connIdx: hdr.connIdx, options: optBarrier, version: hdr.version, data: ack}
+		io.Copy(w, f.marshal(n.blk))
+		return
+	case optReadClosed:
+		l.connsmu.Lock()
+		c := l.connOf(n, hdr.connIdx)
+		l.connsmu.Unlock()
+		if c == nil {
+			l.randomReply(w, r)
+			return
+		}
+		vprint(c, " the other side has closed reading")
+		c.write.Lock()
+		c.write.dropped, c.write.buf = true, nil
+		c.write.Unlock()
+		c.reschedDeath()
+		f := frame{connIdx: hdr.connIdx, options: optReadClosed, version: hdr.version}
+		io.Copy(w, f.marshal(n.blk))
+		return
 	case optPing:
 		l.connsmu.Lock()
 		p := bytes.Buffer{}
 		for i := 0; i < len(hdr.data); i += 8 {
 			connIdx := binary.BigEndian.Uint64(hdr.data[i : i+8])
 
-			if c := l.conns[connIdx]; c != nil && c.read.err == nil && !c.read.closed {
-				if len(c.write.buf) > 0 {
+			if c := l.connOf(n, connIdx); c != nil && c.read.err == nil && !c.read.closed {
+				if c.hasPending() || (l.PushHold > 0 && atomic.LoadInt32(&c.write.holding) == 0) {
+					// In push mode, ask the client to send a request to be held
 					binary.Write(&p, binary.BigEndian, PING_OK)
 				} else {
 					binary.Write(&p, binary.BigEndian, PING_OK_VOID)
@@ -114,8 +238,8 @@ func (l *Listener) handler(w http.ResponseWriter, r *http.Request) {
 		}
 		l.connsmu.Unlock()
 
-		f := frame{options: optPing, data: p.Bytes()}
-		io.Copy(w, f.marshal(l.blk))
+		f := frame{options: optPing, version: hdr.version, data: p.Bytes()}
+		io.Copy(w, f.marshal(n.blk))
 		return
 	default:
 		l.randomReply(w, r)
@@ -125,12 +249,15 @@ func (l *Listener) handler(w http.ResponseWriter, r *http.Request) {
 
 	var conn *ServerConn
 	l.connsmu.Lock()
-	if sc, _ := l.conns[connIdx]; sc != nil {
+	if sc := l.connOf(n, connIdx); sc != nil {
 		conn = sc
 		l.connsmu.Unlock()
 	} else {
 		// New incoming connection?
-		f, ok := parseframe(r.Body, l.blk)
+		f, ok := parseframe(r.Body, n.blk)
+		if ok && l.OnFrame != nil {
+			l.OnFrame(f.connIdx, f.options)
+		}
 		if !ok || f.options&optHello == 0 || f.connIdx != connIdx {
 			if !ok {
 				l.randomReply(w, r)
@@ -141,22 +268,128 @@ func (l *Listener) handler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		conn = newServerConn(connIdx, l)
+		if l.rejectDraining(w) {
+			l.connsmu.Unlock()
+			return
+		}
+
+		if l.conns[connIdx] != nil {
+			// The index is taken by a conn of another network or key
+			vprint("server: rejected hello of an existing conn: ", f)
+			l.connsmu.Unlock()
+			atomic.AddUint64(&l.httpStats.Non200, 1)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if !l.replays.check(f.data) {
+			vprint("server: rejected replayed hello: ", f)
+			l.connsmu.Unlock()
+			atomic.AddUint64(&l.httpStats.Non200, 1)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		plaintext := f.options&optPlaintext > 0
+		if plaintext && !l.AllowPlaintext {
+			vprint("server: rejected plaintext hello: ", f)
+			l.connsmu.Unlock()
+			atomic.AddUint64(&l.httpStats.Non200, 1)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		dataKey := len(f.data) > helloDataSize+1 && f.data[helloDataSize+1]&helloDataKey > 0
+		if !plaintext && dataKey != (n.data != nil) {
+			vprint("server: rejected hello of unmatched data key: ", f)
+			l.connsmu.Unlock()
+			atomic.AddUint64(&l.httpStats.Non200, 1)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		endFrame := len(f.data) > helloDataSize+1 && f.data[helloDataSize+1]&helloEndFrame > 0
+		early := len(f.data) > helloDataSize+1 && f.data[helloDataSize+1]&helloEarlyData > 0
+		earlyKey := len(f.data) > helloDataSize+1 && f.data[helloDataSize+1]&helloEarlyKey > 0
+		if early && earlyKey != (n.hello != nil) {
+			vprint("server: rejected hello of unmatched hello key: ", f)
+			l.connsmu.Unlock()
+			atomic.AddUint64(&l.httpStats.Non200, 1)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		conn = newServerConn(connIdx, l, n)
+		conn.remote, conn.proto = parseRemoteAddr(r.RemoteAddr), "http"
+		if r.TLS != nil {
+			conn.proto = "https"
+		}
 		l.conns[connIdx] = conn
 		l.connsmu.Unlock()
+		l.emit(connIdx, "created", "")
+
+		// Early data are encrypted by the key like the hello, unless HelloKey is set
+		var flags byte
+		if endFrame {
+			conn.read.endFrame = true
+			flags |= helloEndFrame
+		}
+		if early {
+			if earlyKey {
+				conn.read.blk = n.hello
+			}
+			_, err := conn.read.feedframes(r.Body)
+			conn.read.blk = n.blk
+			if err != nil {
+				vprint(conn, " invalid early data: ", err)
+				conn.teardown()
+				return
+			}
+			flags |= helloEarlyData
+		}
+		if plaintext {
+			conn.read.blk = plainBlock{}
+		} else if dataKey {
+			conn.read.blk = n.data
+			flags |= helloDataKey
+		}
+		if n := len(f.data) - helloDataSize - 2; n > 0 && n <= MaxClientVersion {
+			conn.clientVer = string(f.data[helloDataSize+2:])
+		}
+
+		if len(f.data) > helloDataSize {
+			// Acknowledge with the max version supported by both sides
+			if conn.read.version = f.data[helloDataSize]; conn.read.version > l.maxFrameVersion() {
+				conn.read.version = l.maxFrameVersion()
+			}
+			ack := frame{idx: rand.Uint32(), connIdx: connIdx, options: optHello, data: []byte{conn.read.version, flags}}
+			if l.SigningKey != nil {
+				ack.data = signHelloAck(l.SigningKey, f.data, connIdx, ack.data)
+			}
+			io.Copy(w, ack.marshal(n.blk))
+		}
 
 		l.pendingConns <- conn
-		vprint("server: new conn: ", conn)
+		if conn.clientVer != "" {
+			vprint("server: new conn: ", conn, ", client: ", conn.clientVer)
+		} else {
+			vprint("server: new conn: ", conn)
+		}
 		conn.reschedDeath()
 		//conn.writeTo(w)
 		return
 	}
 
-	if datalen, err := conn.read.feedframes(r.Body); err != nil {
+	if datalen, err := conn.read.feedframes(r.Body); err == ErrMemoryLimit {
+		vprint(conn, " rejected request, memory usage: ", l.MemoryUsage())
+		atomic.AddUint64(&l.httpStats.MemoryRejects, 1)
+		atomic.AddUint64(&l.httpStats.Non200, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
 		debugprint("listener feed frames, error: ", err, ", ", conn, " will be deleted")
-		conn.Close()
+		conn.teardown()
 		return
-	} else if datalen == 0 && len(conn.write.buf) == 0 {
+	} else if datalen == 0 && !conn.hasPending() {
 		// Client sent nothing, we treat the request as a ping
 		// However too many pings without:
 		//   1) sending any valid data to us
@@ -170,35 +403,109 @@ func (l *Listener) handler(w http.ResponseWriter, r *http.Request) {
 	conn.writeTo(w)
 }
 
+// connOf returns the conn of connIdx if it belongs to the network n and its key (the one which decrypted
+// the request), so clients of a network or key can't act on conns of others, l.connsmu must be locked
+func (l *Listener) connOf(n lnNetwork, connIdx uint64) *ServerConn {
+	if c := l.conns[connIdx]; c != nil && c.network == n.name && c.key == n.blk {
+		return c
+	}
+	return nil
+}
+
 func (conn *ServerConn) reschedDeath() {
-	conn.schedPurge.Reschedule(func() { conn.Close() }, conn.rev.Timeout)
+	conn.schedPurge.Reschedule(func() { conn.teardown() }, conn.rev.Timeout)
 }
 
 func (conn *ServerConn) writeTo(w io.Writer) {
+	if hold := conn.rev.PushHold; hold > 0 {
+		conn.push(w, hold)
+		return
+	}
+
+	conn.write.Lock()
+	empty := len(conn.write.buf) == 0
+	conn.write.Unlock()
+	if empty {
+		time.Sleep(200 * time.Millisecond)
+	}
+	if conn.writeFrames(w) {
+		conn.writeEnd(w)
+	}
+}
 
-	for i := 0; ; i++ {
+// push holds the response for at most hold, new data will be written onto it immediately
+// when produced. Only one response of the conn can be held at a time
+func (conn *ServerConn) push(w io.Writer, hold time.Duration) {
+	if !atomic.CompareAndSwapInt32(&conn.write.holding, 0, 1) {
+		// Another response is held, it will carry the data
+		io.Copy(w, endframe.marshal(conn.read.blk))
+		return
+	}
+	defer atomic.StoreInt32(&conn.write.holding, 0)
+
+	flusher, _ := w.(http.Flusher)
+	deadline := time.NewTimer(hold)
+	defer deadline.Stop()
+
+	for {
+		if !conn.writeFrames(w) {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		conn.write.Lock()
+		ending := conn.write.closing != nil || conn.write.eof
+		conn.write.Unlock()
+		if _, closed := conn.read.status(); closed || ending {
+			conn.writeEnd(w)
+			return
+		}
+
+		select {
+		case <-conn.write.notify:
+		case <-deadline.C:
+			conn.writeEnd(w)
+			return
+		}
+	}
+}
+
+// maxResponseFrameSize is the max payload of frames written onto responses, a large write buffer is split
+// so the copies made for encryption are bounded, and the client can start reading before the whole buffer arrives
+const maxResponseFrameSize = 256 << 10
+
+// writeFrames writes all buffered data as frames, it returns false if the conn has failed
+func (conn *ServerConn) writeFrames(w io.Writer) bool {
+	for {
 		conn.write.Lock()
 		if len(conn.write.buf) == 0 {
 			conn.write.Unlock()
-			if i == 0 {
-				time.Sleep(200 * time.Millisecond)
-				continue
-			}
-			return
+			return true
 		}
 
+		n := len(conn.write.buf)
+		if n > maxResponseFrameSize {
+			n = maxResponseFrameSize
+		}
 		f := &frame{
 			idx:     conn.write.counter + 1,
 			connIdx: conn.idx,
-			data:    make([]byte, len(conn.write.buf)),
+			version: conn.read.version,
+			data:    make([]byte, n),
 		}
 
 		copy(f.data, conn.write.buf)
-		conn.write.buf = conn.write.buf[:0]
+		conn.read.sizes.observeSent(len(f.data))
+		if n == len(conn.write.buf) {
+			conn.write.buf = conn.write.buf[:0]
+		} else {
+			conn.write.buf = conn.write.buf[n:]
+		}
 		conn.write.counter++
 		conn.write.Unlock()
 
-		deadline := time.Now().Add(conn.rev.Timeout - time.Second)
+		deadline := time.Now().Add(conn.retry)
 	AGAIN:
 		if _, err := io.Copy(w, f.marshal(conn.read.blk)); err != nil {
 			if time.Now().Before(deadline) {
@@ -206,75 +513,249 @@ func (conn *ServerConn) writeTo(w io.Writer) {
 			}
 			vprint("failed to response to client, error: ", err)
 			conn.read.feedError(err)
+			conn.teardown()
+			return false
+		}
+	}
+}
+
+// hasPending returns true if the conn has data, a close or an EOF frame to send
+func (conn *ServerConn) hasPending() bool {
+	conn.write.Lock()
+	defer conn.write.Unlock()
+	return len(conn.write.buf) > 0 || conn.write.closing != nil || conn.write.eof
+}
+
+// writeEnd writes the pending close or EOF frame if any, and the end frame
+func (conn *ServerConn) writeEnd(w io.Writer) {
+	conn.write.Lock()
+	if e := conn.write.closing; (e != nil || conn.write.eof) && len(conn.write.buf) == 0 {
+		conn.write.closing, conn.write.eof = nil, false
+		conn.write.counter++
+		f := frame{idx: conn.write.counter, connIdx: conn.idx, options: optClosed, version: conn.read.version, data: e.marshal()}
+		conn.write.Unlock()
+		io.Copy(w, f.marshal(conn.read.blk))
+		if e != nil {
 			conn.Close()
-			return
 		}
+	} else {
+		conn.write.Unlock()
+	}
+	io.Copy(w, endframe.marshal(conn.read.blk))
+}
+
+// wake wakes up the held response, if any
+func (conn *ServerConn) wake() {
+	select {
+	case conn.write.notify <- true:
+	default:
 	}
 }
 
+// SetContext acts like ClientConn.SetContext
+func (c *ServerConn) SetContext(ctx context.Context) {
+	c.read.setContext(ctx)
+}
+
 func (c *ServerConn) SetReadDeadline(t time.Time) error {
-	c.read.ready.SetWaitDeadline(t)
+	c.read.setReadDeadline(t)
 	return nil
 }
 
 func (c *ServerConn) SetDeadline(t time.Time) error {
 	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
 	return nil
 }
 
+// SetWriteDeadline acts like ClientConn.SetWriteDeadline
 func (c *ServerConn) SetWriteDeadline(t time.Time) error {
+	c.write.deadline.set(t)
 	return nil
 }
 
 func (c *ServerConn) Write(p []byte) (n int, err error) {
 REWRITE:
 	if c.read.closed {
-		return 0, errClosedConn
+		return n, errClosedConn
 	}
 
 	if c.read.err != nil {
-		return 0, c.read.err
+		return n, c.read.err
+	}
+
+	if c.write.closed {
+		return n, ErrWriteAfterClose
 	}
 
-	if len(c.write.buf) > c.rev.MaxWriteBuffer {
+	if c.write.dropped {
+		return n, ErrReadClosedByRemote
+	}
+
+	if c.write.deadline.exceeded() {
+		return n, &timeoutError{}
+	}
+
+	full := len(c.write.buf) > c.rev.MaxWriteBuffer
+	if c.write.deadline.enabled() {
+		full = len(c.write.buf) >= c.rev.MaxWriteBuffer
+	}
+	if full {
+		if c.rev.NonBlockingWrite {
+			return n, ErrBufferFull
+		}
 		vprint("write buffer is full")
-		time.Sleep(time.Second)
+		c.write.deadline.wait(nil)
+		goto REWRITE
+	}
+
+	c.write.Lock()
+	if c.write.closed || c.write.dropped {
+		c.write.Unlock()
+		goto REWRITE
+	}
+	chunk := c.write.deadline.chunk(p, len(c.write.buf), c.rev.MaxWriteBuffer)
+	c.write.buf = append(c.write.buf, chunk...)
+	c.write.Unlock()
+	c.wake()
+	n, p = n+len(chunk), p[len(chunk):]
+
+	if len(p) > 0 {
 		goto REWRITE
 	}
+	return n, nil
+}
 
+// CloseWrite shuts down the writing side, the client side will read io.EOF after all data written before.
+// Any further Write will return ErrWriteAfterClose, reading is not affected
+func (c *ServerConn) CloseWrite() error {
+	if c.read.closed {
+		return errClosedConn
+	}
 	c.write.Lock()
-	c.write.buf = append(c.write.buf, p...)
+	if !c.write.closed {
+		c.write.closed, c.write.eof = true, true
+	}
 	c.write.Unlock()
-	return len(p), nil
+	c.wake()
+	return nil
+}
+
+// CloseRead shuts down the reading side, buffered and further incoming data are discarded and Read
+// returns io.EOF. The client is not told, writing is not affected
+func (c *ServerConn) CloseRead() error {
+	if c.read.closed {
+		return errClosedConn
+	}
+	c.read.closeRead()
+	return nil
 }
 
 func (c *ServerConn) Read(p []byte) (n int, err error) {
 	return c.read.Read(p)
 }
 
+// WriteBufferedBytes returns the number of bytes written but not sent yet
+func (c *ServerConn) WriteBufferedBytes() int {
+	c.write.Lock()
+	defer c.write.Unlock()
+	return len(c.write.buf)
+}
+
+// ReadBufferedBytes returns the number of bytes received but not read yet
+func (c *ServerConn) ReadBufferedBytes() int {
+	return c.read.buffered()
+}
+
+// OptimalWriteSize acts like ClientConn.OptimalWriteSize, larger writes are split into frames of at most
+// maxResponseFrameSize anyway
+func (c *ServerConn) OptimalWriteSize() int {
+	c.write.Lock()
+	buffered := len(c.write.buf)
+	c.write.Unlock()
+	return optimalWriteSize(1, maxResponseFrameSize, c.rev.MaxWriteBuffer-buffered)
+}
+
+func (c *ServerConn) WriteTo(w io.Writer) (n int64, err error) {
+	return c.read.WriteTo(w)
+}
+
 func (c *ServerConn) Close() error {
+	c.read.shutdown()
+	c.teardown()
+	return nil
+}
+
+// teardown releases the conn without changing what Read returns, see readConn.Read
+func (c *ServerConn) teardown() {
+	c.closeOnce.Do(func() {
+		vprint("server: close conn: ", c)
+		c.schedPurge.Cancel()
+		c.read.close()
+		c.read.releaseBudget()
+		c.rev.connsmu.Lock()
+		delete(c.rev.conns, c.idx)
+		c.rev.connsmu.Unlock()
+		c.wake()
+		//vprint(c, " delete", c.rev.conns)
+		if cb := c.rev.OnClose; cb != nil {
+			cb(c)
+		}
+		c.rev.emit(c.idx, "closed", c.read.closeReason())
+	})
+}
+
+// CloseWithError closes the conn after all buffered data are sent, the client side will get
+// a *CloseError of the code and reason from Read
+func (c *ServerConn) CloseWithError(code int, reason string) error {
 	if c.read.closed {
 		return nil
 	}
-
-	vprint("server: close conn: ", c)
-	c.schedPurge.Cancel()
-	c.read.close()
-	c.rev.connsmu.Lock()
-	delete(c.rev.conns, c.idx)
-	c.rev.connsmu.Unlock()
-	//vprint(c, " delete", c.rev.conns)
+	c.write.Lock()
+	c.write.closing = &CloseError{Code: code, Reason: reason}
+	c.write.Unlock()
+	c.wake()
+	c.reschedDeath()
 	return nil
 }
 
+// Network returns the name of the network which the connection belongs to
+func (c *ServerConn) Network() string {
+	return c.network
+}
+
+// ClientVersion returns the Dialer.ClientVersion of the client, empty if not set
+func (c *ServerConn) ClientVersion() string {
+	return c.clientVer
+}
+
+// RemoteAddr returns the address of the client when the conn was created, behind proxies or CDNs,
+// it is the address of the nearest hop
 func (c *ServerConn) RemoteAddr() net.Addr {
-	return &net.TCPAddr{}
+	if c.remote == nil {
+		return &net.TCPAddr{}
+	}
+	return c.remote
+}
+
+func parseRemoteAddr(addr string) net.Addr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
 }
 
 func (c *ServerConn) LocalAddr() net.Addr {
 	return c.rev.Addr()
 }
 
+// SetLogTag acts like ClientConn.SetLogTag
+func (c *ServerConn) SetLogTag(tag string) {
+	c.read.setLogTag(tag)
+}
+
 func (c *ServerConn) String() string {
-	return fmt.Sprintf("<S:%x,r:%d,w:%d>", c.idx, c.read.counter, c.write.counter)
+	return fmt.Sprintf("<S:%s,r:%d,w:%d>", c.read.logTagOr(fmt.Sprintf("%x", c.idx)), c.read.counter, c.write.counter)
 }
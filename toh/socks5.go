@@ -0,0 +1,288 @@
+package toh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const (
+	socksCmdConnect      = 1
+	socksCmdUDPAssociate = 3
+
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+
+	socksSucceeded          = 0
+	socksGeneralFailure     = 1
+	socksHostUnreachable    = 4
+	socksCmdNotSupported    = 7
+	socksAddrNotSupported   = 8
+	socksNoAcceptableMethod = 0xff
+)
+
+// Socks5 serves SOCKS5 clients on the client side, CONNECT and UDP ASSOCIATE requests are carried
+// in tunnel conns and served by Forwarder on the server side. Only "no authentication" is supported.
+// For UDP ASSOCIATE, a local UDP socket is opened for the client, its datagrams are carried by
+// a single tunnel conn (see PacketConn for the semantics), the association ends when the control conn closes
+type Socks5 struct {
+	// Dial opens a tunnel conn, e.g. Dialer.Dial
+	Dial func() (net.Conn, error)
+}
+
+// Serve handles a single SOCKS5 client conn, it returns after the relay ends
+func (s *Socks5) Serve(conn net.Conn) error {
+	defer conn.Close()
+
+	// Greeting: VER | NMETHODS | METHODS
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != 5 {
+		return fmt.Errorf("socks5: invalid version: %d", buf[0])
+	}
+	methods := buf[2 : 2+int(buf[1])]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == 0
+	}
+	if !noAuth {
+		conn.Write([]byte{5, socksNoAcceptableMethod})
+		return fmt.Errorf("socks5: no acceptable method")
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return err
+	}
+
+	// Request: VER | CMD | RSV | ATYP | DST.ADDR | DST.PORT
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return err
+	}
+	cmd := buf[1]
+	host, err := readSocksAddr(conn)
+	if err != nil {
+		socksReply(conn, socksAddrNotSupported, nil)
+		return err
+	}
+
+	switch cmd {
+	case socksCmdConnect:
+		return s.connect(conn, host)
+	case socksCmdUDPAssociate:
+		return s.associate(conn)
+	default:
+		socksReply(conn, socksCmdNotSupported, nil)
+		return fmt.Errorf("socks5: unsupported command: %d", cmd)
+	}
+}
+
+// request opens a tunnel conn and sends the request line to Forwarder
+func (s *Socks5) request(method, uri string) (*BufConn, error) {
+	conn, err := s.Dial()
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel := NewBufConn(conn)
+	if _, err := tunnel.Write([]byte(method + " " + uri + " HTTP/1.1\r\nHost: " + uri + "\r\n\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(tunnel.Reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("socks5: remote: %s", resp.Status)
+	}
+	return tunnel, nil
+}
+
+func (s *Socks5) connect(conn net.Conn, host string) error {
+	tunnel, err := s.request("CONNECT", host)
+	if err != nil {
+		socksReply(conn, socksHostUnreachable, nil)
+		return err
+	}
+
+	if err := socksReply(conn, socksSucceeded, nil); err != nil {
+		tunnel.Close()
+		return err
+	}
+
+	Bridge(conn, tunnel)
+	return nil
+}
+
+func (s *Socks5) associate(conn net.Conn) error {
+	// Open the UDP socket on the same interface as the control conn
+	ip := net.IPv4zero
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		socksReply(conn, socksGeneralFailure, nil)
+		return err
+	}
+	defer pc.Close()
+
+	tc, err := s.request(udpAssociateMethod, "*")
+	if err != nil {
+		socksReply(conn, socksHostUnreachable, nil)
+		return err
+	}
+	tunnel := NewPacketConn(tc)
+	defer tunnel.Close()
+
+	if err := socksReply(conn, socksSucceeded, pc.LocalAddr().(*net.UDPAddr)); err != nil {
+		return err
+	}
+
+	var client *net.UDPAddr
+	clientReady := make(chan bool)
+
+	// Local -> remote
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if client == nil {
+				client = from
+				close(clientReady)
+			} else if !from.IP.Equal(client.IP) || from.Port != client.Port {
+				continue
+			}
+
+			// RSV 2b | FRAG 1b | ATYP | DST.ADDR | DST.PORT | DATA, fragments are not supported
+			if n < 4 || buf[2] != 0 {
+				continue
+			}
+			r := bytes.NewReader(buf[3:n])
+			dst, err := readSocksAddr(r)
+			if err != nil {
+				continue
+			}
+			if _, err := tunnel.WriteTo(buf[n-r.Len():n], datagramAddr(dst)); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	// Remote -> local
+	go func() {
+		defer conn.Close()
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := tunnel.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			hdr, err := socksAddr(from.String())
+			if err != nil {
+				continue
+			}
+			select {
+			case <-clientReady:
+			default:
+				// Nowhere to send
+				continue
+			}
+			pc.WriteToUDP(append(append([]byte{0, 0, 0}, hdr...), buf[:n]...), client)
+		}
+	}()
+
+	// The association lives until the control conn closes
+	io.Copy(ioutil.Discard, conn)
+	return nil
+}
+
+// readSocksAddr reads ATYP | ADDR | PORT and returns "host:port"
+func readSocksAddr(r io.Reader) (string, error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(r, buf[:1]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch buf[0] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ln := net.IPv4len
+		if buf[0] == socksAddrIPv6 {
+			ln = net.IPv6len
+		}
+		if _, err := io.ReadFull(r, buf[:ln]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:ln]).String()
+	case socksAddrDomain:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return "", err
+		}
+		ln := int(buf[0])
+		if _, err := io.ReadFull(r, buf[:ln]); err != nil {
+			return "", err
+		}
+		host = string(buf[:ln])
+	default:
+		return "", fmt.Errorf("socks5: unsupported address type: %d", buf[0])
+	}
+
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf)))), nil
+}
+
+// socksAddr encodes "host:port" as ATYP | ADDR | PORT
+func socksAddr(hostport string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks5: domain too long")
+		}
+		buf = append([]byte{socksAddrDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append([]byte{socksAddrIPv4}, ip4...)
+	} else {
+		buf = append([]byte{socksAddrIPv6}, ip...)
+	}
+	return append(buf, byte(p>>8), byte(p)), nil
+}
+
+// socksReply writes VER | REP | RSV | ATYP | BND.ADDR | BND.PORT
+func socksReply(conn net.Conn, rep byte, bind *net.UDPAddr) error {
+	addr := []byte{socksAddrIPv4, 0, 0, 0, 0, 0, 0}
+	if bind != nil {
+		addr, _ = socksAddr(bind.String())
+	}
+	_, err := conn.Write(append([]byte{5, rep, 0}, addr...))
+	return err
+}
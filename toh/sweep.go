@@ -0,0 +1,39 @@
+package toh
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrConnMaxAge is returned by Read of a conn evicted because it has lived longer than the listener's MaxConnAge
+var ErrConnMaxAge = fmt.Errorf("conn exceeded max age")
+
+// sweep evicts conns older than MaxConnAge every SweepInterval, until the listener is closed
+func (l *Listener) sweep() {
+	tk := time.NewTicker(l.SweepInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+		case <-l.done:
+			return
+		}
+
+		var expired []*ServerConn
+		l.connsmu.Lock()
+		for _, c := range l.conns {
+			if time.Since(c.created) > l.MaxConnAge {
+				expired = append(expired, c)
+			}
+		}
+		l.connsmu.Unlock()
+
+		for _, c := range expired {
+			vprint(c, " evicted, created at ", c.created)
+			atomic.AddUint64(&l.httpStats.Evictions, 1)
+			c.read.feedError(ErrConnMaxAge)
+			c.teardown()
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package toh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpAssociateMethod is the method of the request which starts a UDP association, see Forwarder.
+const udpAssociateMethod = "UDP-ASSOCIATE"
+
+// maxDatagramSize is the max payload size of a single datagram carried in the tunnel
+const maxDatagramSize = 65535 - 1 - 255
+
+// PacketConn carries datagrams over a tunnel conn, each datagram is framed as:
+//
+//	length 2b | address length 1b | address ("host:port") | payload
+//
+// where length covers everything after itself. For local datagrams the address is the destination,
+// for datagrams arriving from the remote it is the source.
+//
+// Unlike real UDP, datagrams are never lost or reordered by the tunnel itself (unless the conn is
+// in unordered mode), but they can be delayed by retries and flushes, and all of them will be lost
+// when the conn fails. A datagram will be silently dropped by the forwarder if its destination
+// can't be resolved or is rejected by Forwarder.TargetFilter
+type PacketConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	rmu  sync.Mutex
+	wmu  sync.Mutex
+}
+
+// NewPacketConn wraps the tunnel conn, the other side should wrap its conn too
+func NewPacketConn(conn net.Conn) *PacketConn {
+	c := &PacketConn{conn: conn}
+	if bc, ok := conn.(*BufConn); ok {
+		c.r = bc.Reader
+	} else {
+		c.r = bufio.NewReader(conn)
+	}
+	return c
+}
+
+// datagramAddr is the address carried with datagrams, it is not resolved
+type datagramAddr string
+
+func (a datagramAddr) Network() string { return "udp" }
+
+func (a datagramAddr) String() string { return string(a) }
+
+func (c *PacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	var hdr [3]byte
+	if _, err = io.ReadFull(c.r, hdr[:]); err != nil {
+		return
+	}
+
+	ln, alen := int(binary.BigEndian.Uint16(hdr[:])), int(hdr[2])
+	if ln < 1+alen {
+		return 0, nil, fmt.Errorf("invalid datagram")
+	}
+
+	buf := make([]byte, ln-1)
+	if _, err = io.ReadFull(c.r, buf); err != nil {
+		return
+	}
+	return copy(p, buf[alen:]), datagramAddr(buf[:alen]), nil
+}
+
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	a := addr.String()
+	if len(a) > 255 || len(p) > maxDatagramSize {
+		return 0, fmt.Errorf("datagram too large")
+	}
+
+	buf := make([]byte, 3, 3+len(a)+len(p))
+	binary.BigEndian.PutUint16(buf, uint16(1+len(a)+len(p)))
+	buf[2] = byte(len(a))
+	buf = append(append(buf, a...), p...)
+
+	// Write the whole datagram at once, so it won't be interleaved
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if _, err = c.conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *PacketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// serveUDP relays datagrams between the tunnel conn and a UDP socket, until either side fails
+func (f *Forwarder) serveUDP(down *BufConn) error {
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		down.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nConnection: close\r\n\r\n" + err.Error()))
+		down.Close()
+		return err
+	}
+
+	if _, err := down.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
+		down.Close()
+		pc.Close()
+		return err
+	}
+
+	tunnel := NewPacketConn(down)
+	go func() {
+		defer pc.Close()
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := tunnel.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			target, err := f.filter(addr.String())
+			if err != nil {
+				vprint("udp forwarder: rejected target ", addr, ": ", err)
+				continue
+			}
+			dst, err := net.ResolveUDPAddr("udp", target)
+			if err != nil {
+				vprint("udp forwarder: ", err)
+				continue
+			}
+			pc.WriteTo(buf[:n], dst)
+		}
+	}()
+
+	defer tunnel.Close()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return nil
+		}
+		if _, err := tunnel.WriteTo(buf[:n], from); err != nil {
+			pc.Close()
+			return err
+		}
+	}
+}
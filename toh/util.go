@@ -3,13 +3,16 @@ package toh
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -17,8 +20,20 @@ import (
 var (
 	debug   = false
 	Verbose = true
+
+	// LogPayload includes payloads of frames in logs, otherwise only their sizes are logged.
+	// Payloads may carry credentials, enable it for debugging only
+	LogPayload = false
 )
 
+// payloadOf returns data for logging, redacted unless LogPayload is set
+func payloadOf(data []byte) interface{} {
+	if LogPayload {
+		return data
+	}
+	return fmt.Sprintf("<%d bytes>", len(data))
+}
+
 type timeoutError struct{}
 
 func (e *timeoutError) Error() string {
@@ -33,6 +48,84 @@ func (e *timeoutError) Temporary() bool {
 	return false
 }
 
+// writeDeadline bounds a whole Write blocked by the full write buffer, the data are then written in pieces
+// fitting in the buffer, across as many sends as needed, see SetWriteDeadline
+type writeDeadline struct {
+	t int64 // UnixNano, 0 means no deadline
+}
+
+func (d *writeDeadline) set(t time.Time) {
+	if t.IsZero() {
+		atomic.StoreInt64(&d.t, 0)
+	} else {
+		atomic.StoreInt64(&d.t, t.UnixNano())
+	}
+}
+
+// get returns the deadline, zero if not set
+func (d *writeDeadline) get() time.Time {
+	if t := atomic.LoadInt64(&d.t); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+func (d *writeDeadline) enabled() bool {
+	return atomic.LoadInt64(&d.t) != 0
+}
+
+func (d *writeDeadline) exceeded() bool {
+	t := atomic.LoadInt64(&d.t)
+	return t != 0 && time.Now().UnixNano() >= t
+}
+
+// wait sleeps before a blocked write checks the buffer again, no longer than the deadline or until wake is signaled
+func (d *writeDeadline) wait(wake <-chan struct{}) {
+	wait := time.Second
+	if t := atomic.LoadInt64(&d.t); t != 0 {
+		if left := time.Duration(t - time.Now().UnixNano()); left < wait {
+			wait = left
+		}
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-wake:
+	}
+}
+
+// chunk returns the part of p fitting in the write buffer when the deadline is set, otherwise p
+func (d *writeDeadline) chunk(p []byte, buffered, max int) []byte {
+	if !d.enabled() {
+		return p
+	}
+	if free := max - buffered; free <= 0 {
+		return nil
+	} else if free < len(p) {
+		return p[:free]
+	}
+	return p
+}
+
+// ErrBufferFull is returned by Write in non-blocking mode when the write buffer is full, it is temporary:
+// callers should back off and retry the write later, see CommonOptions.NonBlockingWrite
+var ErrBufferFull net.Error = &bufferFullError{}
+
+type bufferFullError struct{}
+
+func (e *bufferFullError) Error() string {
+	return "write buffer is full"
+}
+
+func (e *bufferFullError) Timeout() bool {
+	return false
+}
+
+func (e *bufferFullError) Temporary() bool {
+	return true
+}
+
 func debugprint(v ...interface{}) {
 	if !debug {
 		return
@@ -111,3 +204,116 @@ func (c *BufConn) Write(p []byte) (int, error) {
 func (c *BufConn) Read(p []byte) (int, error) {
 	return c.Reader.Read(p)
 }
+
+// wallclock is the wall clock, only used by timestamps exchanged with the peer, where the clocks of both
+// sides are compared. It can be stepped by NTP or jump after a suspend, so durations must use monotime
+var wallclock = time.Now
+
+var monoStart = time.Now()
+
+// monotime returns nanoseconds on the monotonic clock for timestamps stored as integers, which lose the
+// monotonic reading of time.Time. It is never 0, so 0 can mean unset
+func monotime() int64 {
+	return int64(time.Since(monoStart)) + 1
+}
+
+// mergeContext returns a context which is done when either a or b is done, values are looked up in a
+func mergeContext(a, b context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(a)
+	go func() {
+		select {
+		case <-b.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// jitter shortens d by a random fraction up to f
+func jitter(d time.Duration, f float64) time.Duration {
+	if f <= 0 {
+		return d
+	}
+	if f > 1 {
+		f = 1
+	}
+	return d - time.Duration(float64(d)*f*rand.Float64())
+}
+
+// optimalWriteSize returns the preferred size clamped to [floor, free], but never less than 1.
+// The preferred size leaves room in the write buffer for writes coming while a send is in flight
+func optimalWriteSize(floor, preferred, free int) int {
+	size := preferred
+	if size < floor {
+		size = floor
+	}
+	if size > free {
+		size = free
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+type timeoutConn struct {
+	net.Conn
+	read, write time.Duration
+}
+
+// WithTimeouts wraps the conn so that every Read (Write) must complete in the duration, by setting
+// the read (write) deadline before each call. 0 means the deadline is left to the caller, which
+// includes clearing it with a zero time.Time
+func WithTimeouts(c net.Conn, read, write time.Duration) net.Conn {
+	return &timeoutConn{Conn: c, read: read, write: write}
+}
+
+func (c *timeoutConn) Read(p []byte) (int, error) {
+	if c.read > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.read)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *timeoutConn) Write(p []byte) (int, error) {
+	if c.write > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.write)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(p)
+}
+
+var copyBufPool = sync.Pool{New: func() interface{} { return make([]byte, 32*1024) }}
+
+// Bridge copies data between a and b in both directions, it returns after both directions end, with both closed.
+// When one side reaches EOF, the other side will be half closed if it supports CloseWrite (e.g. *net.TCPConn),
+// otherwise, or when an error occurs, both will be closed at once.
+// It prefers WriterTo and ReaderFrom (ClientConn and ServerConn implement WriterTo), otherwise a pooled buffer is used
+func Bridge(a, b io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+	pipe := func(dst, src io.ReadWriteCloser) {
+		defer wg.Done()
+
+		buf := copyBufPool.Get().([]byte)
+		_, err := io.CopyBuffer(dst, src, buf)
+		copyBufPool.Put(buf)
+
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && err == nil {
+			cw.CloseWrite()
+			return
+		}
+		a.Close()
+		b.Close()
+	}
+
+	wg.Add(2)
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
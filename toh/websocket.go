@@ -1,6 +1,7 @@
 package toh
 
 import (
+	"bytes"
 	"crypto/cipher"
 	"crypto/sha1"
 	"crypto/tls"
@@ -8,37 +9,60 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
 )
 
+// wsMaxFrameData is the max data size of a frame carried in a single websocket message
+const wsMaxFrameData = 65535 - 20 - 16
+
+// WSConn carries the stream over a websocket, each write is sent as frames (see frame.marshal) in binary messages.
+// Each side marks its frames with its own random index and an increasing counter, so the GCM nonces never repeat,
+// and dropped or replayed messages will fail the read
 type WSConn struct {
 	net.Conn
 	mu   sync.Mutex
+	wmu  sync.Mutex
 	blk  cipher.Block
 	mask bool
 	buf  []byte
+
+	idx       uint64 // index of frames sent by this side
+	counter   uint32 // counter of frames sent by this side
+	peerIdx   uint64
+	peerCount uint32
 }
 
-func (c *WSConn) Write(p []byte) (int, error) {
-	L := len(p)
+func newWSConn(conn net.Conn, blk cipher.Block, mask bool) *WSConn {
+	return &WSConn{Conn: conn, blk: blk, mask: mask, idx: newConnectionIdx()}
+}
 
-	// TODO
-	key := make([]byte, 12)
-	rand.Read(key)
+func (c *WSConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
 
-	gcm, _ := cipher.NewGCM(c.blk)
+	for n := 0; n < len(p); {
+		data := p[n:]
+		if len(data) > wsMaxFrameData {
+			data = data[:wsMaxFrameData]
+		}
 
-	p = gcm.Seal(p[:0], key, p, nil)
-	p = append(p, key...)
+		c.counter++
+		// marshal encrypts data in place, don't touch the caller's buffer
+		f := frame{idx: c.counter, connIdx: c.idx, data: append([]byte{}, data...)}
+		msg, _ := ioutil.ReadAll(f.marshal(c.blk))
 
-	if _, err := wsWrite(c.Conn, p, c.mask); err != nil {
-		return 0, err
+		if _, err := wsWrite(c.Conn, msg, c.mask); err != nil {
+			return n, err
+		}
+		n += len(data)
 	}
-	return L, nil
+	return len(p), nil
 }
 
 func (c *WSConn) Read(p []byte) (int, error) {
@@ -56,21 +80,20 @@ READ:
 	if err != nil {
 		return 0, err
 	}
-	if len(payload) < 12 {
+
+	f, ok := parseframe(ioutil.NopCloser(bytes.NewReader(payload)), c.blk)
+	if !ok {
 		return 0, fmt.Errorf("invalid websocket payload")
 	}
-
-	key := payload[len(payload)-12:]
-	payload = payload[:len(payload)-12]
-
-	gcm, _ := cipher.NewGCM(c.blk)
-
-	payload, err = gcm.Open(payload[:0], key, payload, nil)
-	if err != nil {
-		return 0, err
+	if c.peerCount == 0 {
+		c.peerIdx = f.connIdx
+	}
+	if f.connIdx != c.peerIdx || f.idx != c.peerCount+1 {
+		return 0, fmt.Errorf("unexpected websocket frame: %v", f)
 	}
+	c.peerCount = f.idx
 
-	c.buf = payload
+	c.buf = f.data
 	goto READ
 }
 
@@ -79,12 +102,16 @@ func (d *Dialer) wsHandshake() (net.Conn, error) {
 		host  = d.endpoint
 		conn  net.Conn
 		err   error
-		https bool
+		https = d.TLSConfig != nil
 	)
 
 REDIR:
 	if https {
-		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: d.Timeout}, "tcp", host, &tls.Config{InsecureSkipVerify: true})
+		config := d.TLSConfig
+		if config == nil {
+			config = &tls.Config{InsecureSkipVerify: true}
+		}
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: d.Timeout}, "tcp", host, config)
 	} else {
 		conn, err = net.DialTimeout("tcp", host, d.Timeout)
 	}
@@ -113,11 +140,7 @@ REDIR:
 		return nil, err
 	}
 
-	c := &WSConn{
-		Conn: NewBufConn(conn),
-		mask: true,
-		blk:  d.blk,
-	}
+	c := newWSConn(NewBufConn(conn), d.blk, true)
 
 	resp, err := http.ReadResponse(c.Conn.(*BufConn).Reader, nil)
 	if err != nil {
@@ -150,12 +173,14 @@ REDIR:
 	return c, nil
 }
 
-func (ln *Listener) wsHandShake(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+func (ln *Listener) wsHandShake(w http.ResponseWriter, r *http.Request, blk cipher.Block) (net.Conn, error) {
 	ans := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
 	conn, _, err := w.(http.Hijacker).Hijack()
 	if err != nil {
 		return nil, err
 	}
+	// Deadlines set by the request timeout shouldn't apply to the hijacked conn
+	conn.SetDeadline(time.Time{})
 
 	if _, err := conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
 		"Upgrade: websocket\r\n" +
@@ -165,7 +190,7 @@ func (ln *Listener) wsHandShake(w http.ResponseWriter, r *http.Request) (net.Con
 		return nil, err
 	}
 
-	return &WSConn{Conn: conn, blk: ln.blk}, nil
+	return newWSConn(conn, blk, false), nil
 }
 
 // WSWrite and WSRead are simple implementations of RFC6455
@@ -0,0 +1,44 @@
+package toh
+
+import (
+	"net"
+	"sync"
+)
+
+var wrapDialers struct {
+	sync.Mutex
+	m map[string]*Dialer
+}
+
+// DialWrap dials a tunnel to address and relays local through it, it returns after both sides end.
+// Dialers are shared among calls with the same network and address
+func DialWrap(network, address string, local net.Conn) error {
+	return sharedDialer(network, address).DialWrap(local)
+}
+
+// sharedDialer returns the dialer shared by DialWrap and RoundTrip for the network and address
+func sharedDialer(network, address string) *Dialer {
+	wrapDialers.Lock()
+	defer wrapDialers.Unlock()
+	d := wrapDialers.m[network+"/"+address]
+	if d == nil {
+		if wrapDialers.m == nil {
+			wrapDialers.m = map[string]*Dialer{}
+		}
+		d = NewDialer(network, address)
+		wrapDialers.m[network+"/"+address] = d
+	}
+	return d
+}
+
+// DialWrap dials a tunnel and relays local through it, it returns after both sides end
+func (d *Dialer) DialWrap(local net.Conn) error {
+	conn, err := d.Dial()
+	if err != nil {
+		local.Close()
+		return err
+	}
+
+	Bridge(local, conn)
+	return nil
+}